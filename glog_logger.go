@@ -42,6 +42,9 @@ func (l glogLogger) Log(msg dhcplb.LogMessage) error {
 		sample["error_name"] = msg.ErrorName
 		sample["error_details"] = fmt.Sprintf("%s", msg.ErrorDetails)
 	}
+	if msg.Event {
+		sample["event"] = true
+	}
 
 	if msg.Packet != nil {
 		if msg.Version == 4 {
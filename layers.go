@@ -0,0 +1,53 @@
+/**
+ * Copyright (c) Facebook, Inc. and its affiliates.
+ *
+ * This source code is licensed under the MIT license found in the
+ * LICENSE file in the root directory of this source tree.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	dhcplb "github.com/facebookincubator/dhcplb/lib"
+)
+
+const setUsage = "Set a field of the config, overriding the config file and the DHCPLB_V<version>_<FIELD> environment variables, eg v4.rc_ratio=10. Can be repeated"
+
+// setFlag is a flag.Value adding the fields given as "v<version>.<field>=<value>"
+// to a config layer.
+type setFlag struct {
+	layer *dhcplb.ConfigLayer
+}
+
+func (f setFlag) String() string {
+	return ""
+}
+
+func (f setFlag) Set(s string) error {
+	setting, value, ok := strings.Cut(s, "=")
+	prefix, field, ok2 := strings.Cut(setting, ".")
+	if !ok || !ok2 {
+		return fmt.Errorf("expected v<version>.<field>=<value>")
+	}
+	version, err := strconv.Atoi(strings.TrimPrefix(prefix, "v"))
+	if err != nil || !strings.HasPrefix(prefix, "v") {
+		return fmt.Errorf("invalid version %s", prefix)
+	}
+	return f.layer.Set(version, field, value)
+}
+
+// setConfigLayers makes the config fields set by environment variables, and
+// by the -set flags, override the config file.
+func setConfigLayers(flags *dhcplb.ConfigLayer) error {
+	env, err := dhcplb.NewEnvConfigLayer(os.Environ())
+	if err != nil {
+		return err
+	}
+	dhcplb.SetConfigLayers(env, flags)
+	return nil
+}
@@ -0,0 +1,543 @@
+/**
+ * Copyright (c) Facebook, Inc. and its affiliates.
+ *
+ * This source code is licensed under the MIT license found in the
+ * LICENSE file in the root directory of this source tree.
+ */
+
+package dhcplb
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// adminState holds the changes made at runtime through the admin API. They
+// aren't persisted and are lost on restart.
+type adminState struct {
+	lock      sync.Mutex
+	drained   map[string]bool
+	overrides map[string]temporaryOverride
+	changed   chan struct{}
+}
+
+// temporaryOverride is an override added through the admin API, it takes
+// precedence over the ones in the overrides file.
+type temporaryOverride struct {
+	Override
+	expires time.Time
+}
+
+func newAdminState() *adminState {
+	return &adminState{
+		drained:   make(map[string]bool),
+		overrides: make(map[string]temporaryOverride),
+		changed:   make(chan struct{}, 1),
+	}
+}
+
+// drain stops (or resumes) sending new clients to the servers with address
+// addr.
+func (a *adminState) drain(addr string, drained bool) {
+	a.lock.Lock()
+	if drained {
+		a.drained[addr] = true
+	} else {
+		delete(a.drained, addr)
+	}
+	a.lock.Unlock()
+	select {
+	case a.changed <- struct{}{}:
+	default:
+	}
+}
+
+func (a *adminState) isDrained(server *DHCPServer) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.drained[server.Address.String()]
+}
+
+func (a *adminState) drainedServers() []string {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	drained := make([]string, 0, len(a.drained))
+	for addr := range a.drained {
+		drained = append(drained, addr)
+	}
+	sort.Strings(drained)
+	return drained
+}
+
+func (a *adminState) setOverride(mac string, override Override, ttl time.Duration) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.overrides[mac] = temporaryOverride{override, time.Now().Add(ttl)}
+}
+
+func (a *adminState) deleteOverride(mac string) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	_, ok := a.overrides[mac]
+	delete(a.overrides, mac)
+	return ok
+}
+
+// override returns the temporary override of mac, if it didn't expire.
+func (a *adminState) override(mac string) (Override, bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	override, ok := a.overrides[mac]
+	if !ok {
+		return Override{}, false
+	}
+	if time.Now().After(override.expires) {
+		delete(a.overrides, mac)
+		return Override{}, false
+	}
+	return override.Override, true
+}
+
+func (a *adminState) temporaryOverrides() map[string]temporaryOverride {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	overrides := make(map[string]temporaryOverride, len(a.overrides))
+	now := time.Now()
+	for mac, override := range a.overrides {
+		if now.After(override.expires) {
+			delete(a.overrides, mac)
+			continue
+		}
+		overrides[mac] = override
+	}
+	return overrides
+}
+
+// AdminHandler returns the handler of the admin HTTP API, which exposes the
+// state of the server as JSON. Endpoints changing the state (draining servers
+// and adding temporary overrides) are only enabled when Config.AdminWrites is
+// set.
+//
+//	GET    /config               the current config, without extras
+//	GET    /reload               the outcome of the config reloads
+//	GET    /servers              the stable and RC servers in rotation
+//	GET    /overrides            the overrides from the file and the temporary ones
+//	POST   /overrides            {"mac": ..., "host"|"tier": ..., "fallback": ..., "ttl": "1h"}
+//	DELETE /overrides?mac=...    remove a temporary override
+//	GET    /throttle             the throttling state of each server
+//	GET    /drain                the servers drained through the API
+//	POST   /drain                {"address": ...}
+//	DELETE /drain?address=...    stop draining a server
+func (s *Server) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/config", s.adminConfig)
+	mux.HandleFunc("/reload", s.adminReload)
+	mux.HandleFunc("/servers", s.adminServers)
+	mux.HandleFunc("/overrides", s.adminOverrides)
+	mux.HandleFunc("/throttle", s.adminThrottle)
+	mux.HandleFunc("/drain", s.adminDrain)
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		glog.Errorf("Error writing admin API response: %s", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, format string, args ...interface{}) {
+	writeJSON(w, status, map[string]string{"error": fmt.Sprintf(format, args...)})
+}
+
+// allowed checks the method of the request, and that writes are enabled for
+// the ones changing the state of the server.
+func (s *Server) allowed(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if r.Method != method {
+			continue
+		}
+		if method != http.MethodGet && !s.GetConfig().AdminWrites {
+			writeError(w, http.StatusForbidden, "admin writes are disabled, set admin_writes in the config to enable them")
+			return false
+		}
+		return true
+	}
+	writeError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+	return false
+}
+
+type healthCheckView struct {
+	Interval  string `json:"interval"`
+	Timeout   string `json:"timeout"`
+	Rise      int    `json:"rise"`
+	Fall      int    `json:"fall"`
+	Probe     string `json:"probe"`
+	RelayAddr string `json:"relay_addr"`
+}
+
+type replyTrackingView struct {
+	Window        string  `json:"window"`
+	HoldDown      string  `json:"hold_down"`
+	ReplyTimeout  string  `json:"reply_timeout"`
+	MinRequests   int     `json:"min_requests"`
+	MinReplyRatio float64 `json:"min_reply_ratio"`
+}
+
+type workerPoolView struct {
+	Workers    int    `json:"workers"`
+	QueueSize  int    `json:"queue_size"`
+	DropPolicy string `json:"drop_policy"`
+}
+
+type relayAgentInfoView struct {
+	Policy           string `json:"policy"`
+	CircuitID        string `json:"circuit_id,omitempty"`
+	RemoteID         string `json:"remote_id,omitempty"`
+	LinkSelection    string `json:"link_selection,omitempty"`
+	ServerIDOverride string `json:"server_id_override,omitempty"`
+	StripReplies     bool   `json:"strip_replies"`
+}
+
+type relayOptionsView struct {
+	LinkAddress            string `json:"link_address"`
+	InterfaceID            string `json:"interface_id,omitempty"`
+	RemoteID               string `json:"remote_id,omitempty"`
+	EnterpriseNumber       uint32 `json:"enterprise_number,omitempty"`
+	SubscriberID           string `json:"subscriber_id,omitempty"`
+	ClientLinkLayerAddress bool   `json:"client_link_layer_address"`
+}
+
+// configView is the sanitized config returned by the admin API, extras are
+// left out as they may hold secrets.
+type configView struct {
+	Version              int                 `json:"version"`
+	ListenAddr           string              `json:"listen_addr"`
+	Algorithm            string              `json:"algorithm"`
+	UpdateServerInterval string              `json:"update_server_interval"`
+	PacketBufSize        int                 `json:"packet_buf_size"`
+	RCRatio              uint32              `json:"rc_ratio"`
+	CacheSize            int                 `json:"throttle_cache_size"`
+	CacheRate            int                 `json:"throttle_cache_rate"`
+	Rate                 int                 `json:"throttle_rate"`
+	ReplyAddr            string              `json:"reply_addr"`
+	HealthCheck          *healthCheckView    `json:"health_check,omitempty"`
+	ReplyTracking        *replyTrackingView  `json:"reply_tracking,omitempty"`
+	ShutdownTimeout      string              `json:"shutdown_timeout"`
+	WorkerPool           *workerPoolView     `json:"worker_pool,omitempty"`
+	ListenSockets        int                 `json:"listen_sockets"`
+	BatchSize            int                 `json:"batch_size"`
+	AdminWrites          bool                `json:"admin_writes"`
+	AffinitySize         int                 `json:"affinity_size"`
+	RelayTableSize       int                 `json:"relay_table_size"`
+	RelayAgentInfo       *relayAgentInfoView `json:"relay_agent_info,omitempty"`
+	MaxHops              int                 `json:"max_hops"`
+	ZeroGiaddr           string              `json:"zero_giaddr,omitempty"`
+	Giaddr               string              `json:"giaddr,omitempty"`
+	RewriteGiaddr        bool                `json:"rewrite_giaddr"`
+	RelaySubnets         []string            `json:"relay_subnets,omitempty"`
+	RelayOptions         *relayOptionsView   `json:"relay_options,omitempty"`
+	// fields set by environment variables or flags, with their source
+	Sources map[string]string `json:"sources,omitempty"`
+}
+
+func newConfigView(config *Config) *configView {
+	view := &configView{
+		Version:              config.Version,
+		ListenAddr:           config.Addr.String(),
+		Algorithm:            config.Algorithm.Name(),
+		UpdateServerInterval: config.ServerUpdateInterval.String(),
+		PacketBufSize:        config.PacketBufSize,
+		RCRatio:              config.RCRatio,
+		CacheSize:            config.CacheSize,
+		CacheRate:            config.CacheRate,
+		Rate:                 config.Rate,
+		ShutdownTimeout:      config.ShutdownTimeout.String(),
+		ListenSockets:        config.ListenSockets,
+		BatchSize:            config.BatchSize,
+		AdminWrites:          config.AdminWrites,
+		AffinitySize:         config.AffinitySize,
+		RelayTableSize:       config.RelayTableSize,
+		MaxHops:              config.MaxHops,
+		ZeroGiaddr:           config.ZeroGiaddr,
+		RewriteGiaddr:        config.RewriteGiaddr,
+		Sources:              config.sources,
+	}
+	if config.Giaddr != nil {
+		view.Giaddr = config.Giaddr.String()
+	}
+	for _, subnet := range config.RelaySubnets {
+		view.RelaySubnets = append(view.RelaySubnets, subnet.String())
+	}
+	if config.ReplyAddr != nil && config.ReplyAddr.IP != nil {
+		view.ReplyAddr = config.ReplyAddr.IP.String()
+	}
+	if hc := config.HealthCheck; hc != nil {
+		view.HealthCheck = &healthCheckView{
+			Interval: hc.Interval.String(),
+			Timeout:  hc.Timeout.String(),
+			Rise:     hc.Rise,
+			Fall:     hc.Fall,
+			Probe:    hc.Probe,
+		}
+		if hc.RelayAddr != nil {
+			view.HealthCheck.RelayAddr = hc.RelayAddr.String()
+		}
+	}
+	if rt := config.ReplyTracking; rt != nil {
+		view.ReplyTracking = &replyTrackingView{
+			Window:        rt.Window.String(),
+			HoldDown:      rt.HoldDown.String(),
+			ReplyTimeout:  rt.ReplyTimeout.String(),
+			MinRequests:   rt.MinRequests,
+			MinReplyRatio: rt.MinReplyRatio,
+		}
+	}
+	if wp := config.WorkerPool; wp != nil {
+		view.WorkerPool = &workerPoolView{
+			Workers:    wp.Workers,
+			QueueSize:  wp.QueueSize,
+			DropPolicy: wp.DropPolicy,
+		}
+	}
+	if rai := config.RelayAgentInfo; rai != nil {
+		view.RelayAgentInfo = &relayAgentInfoView{
+			Policy:       rai.Policy,
+			CircuitID:    string(rai.CircuitID),
+			RemoteID:     string(rai.RemoteID),
+			StripReplies: rai.StripReplies,
+		}
+		if rai.LinkSelection != nil {
+			view.RelayAgentInfo.LinkSelection = rai.LinkSelection.String()
+		}
+		if rai.ServerIDOverride != nil {
+			view.RelayAgentInfo.ServerIDOverride = rai.ServerIDOverride.String()
+		}
+	}
+	if ro := config.RelayOptions; ro != nil {
+		view.RelayOptions = &relayOptionsView{
+			LinkAddress:            net.IPv6zero.String(),
+			InterfaceID:            string(ro.InterfaceID),
+			SubscriberID:           string(ro.SubscriberID),
+			ClientLinkLayerAddress: ro.ClientLinkLayerAddr,
+		}
+		if ro.LinkAddr != nil {
+			view.RelayOptions.LinkAddress = ro.LinkAddr.String()
+		}
+		if ro.InheritLinkAddr {
+			view.RelayOptions.LinkAddress = LinkAddrRelay
+		}
+		if ro.RemoteID != nil {
+			view.RelayOptions.RemoteID = string(ro.RemoteID.RemoteID)
+			view.RelayOptions.EnterpriseNumber = ro.RemoteID.EnterpriseNumber
+		}
+	}
+	return view
+}
+
+func (s *Server) adminConfig(w http.ResponseWriter, r *http.Request) {
+	if !s.allowed(w, r, http.MethodGet) {
+		return
+	}
+	writeJSON(w, http.StatusOK, newConfigView(s.GetConfig()))
+}
+
+func (s *Server) adminReload(w http.ResponseWriter, r *http.Request) {
+	if !s.allowed(w, r, http.MethodGet) {
+		return
+	}
+	writeJSON(w, http.StatusOK, GetReloadStatus(s.GetConfig().Version))
+}
+
+type serverView struct {
+	Hostname string `json:"hostname"`
+	Address  string `json:"address"`
+	Port     int    `json:"port"`
+	Weight   int    `json:"weight"`
+	Healthy  bool   `json:"healthy"`
+	Degraded bool   `json:"degraded"`
+	Draining bool   `json:"draining"`
+}
+
+func (s *Server) newServerViews(list []*DHCPServer) []serverView {
+	views := make([]serverView, 0, len(list))
+	for _, server := range list {
+		views = append(views, serverView{
+			Hostname: server.Hostname,
+			Address:  server.Address.String(),
+			Port:     server.Port,
+			Weight:   server.weight(),
+			Healthy:  s.health.isHealthy(server),
+			Degraded: s.replies.isDegraded(server),
+			Draining: server.Draining,
+		})
+	}
+	return views
+}
+
+func (s *Server) adminServers(w http.ResponseWriter, r *http.Request) {
+	if !s.allowed(w, r, http.MethodGet) {
+		return
+	}
+	stable, rc := s.serverLists()
+	writeJSON(w, http.StatusOK, map[string][]serverView{
+		"stable": s.newServerViews(stable),
+		"rc":     s.newServerViews(rc),
+	})
+}
+
+type overrideView struct {
+	Host       string `json:"host,omitempty"`
+	Tier       string `json:"tier,omitempty"`
+	Start      string `json:"start,omitempty"`
+	Expiration string `json:"expiration,omitempty"`
+	Fallback   string `json:"fallback,omitempty"`
+	Active     bool   `json:"active"`
+	Temporary  bool   `json:"temporary"`
+}
+
+// overrideRequest is the body of POST /overrides.
+type overrideRequest struct {
+	Mac      string `json:"mac"`
+	Host     string `json:"host"`
+	Tier     string `json:"tier"`
+	Fallback string `json:"fallback"`
+	TTL      string `json:"ttl"`
+}
+
+func (s *Server) adminOverrides(w http.ResponseWriter, r *http.Request) {
+	if !s.allowed(w, r, http.MethodGet, http.MethodPost, http.MethodDelete) {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		views := make(map[string]overrideView)
+		config := s.GetConfig()
+		for key, override := range config.Overrides {
+			views[key] = overrideView{
+				Host:       override.Host,
+				Tier:       override.Tier,
+				Start:      override.Start,
+				Expiration: override.Expiration,
+				Fallback:   override.Fallback,
+				Active:     config.activeOverrides.isActive(key),
+			}
+		}
+		// temporary overrides take precedence
+		for mac, override := range s.admin.temporaryOverrides() {
+			views[mac] = overrideView{
+				Host:       override.Host,
+				Tier:       override.Tier,
+				Expiration: override.expires.Format(time.RFC3339),
+				Fallback:   override.Fallback,
+				Active:     true,
+				Temporary:  true,
+			}
+		}
+		writeJSON(w, http.StatusOK, views)
+	case http.MethodPost:
+		var req overrideRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid request: %s", err)
+			return
+		}
+		mac, err := net.ParseMAC(req.Mac)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid mac: %s", err)
+			return
+		}
+		if req.Host == "" && req.Tier == "" {
+			writeError(w, http.StatusBadRequest, "either host or tier is required")
+			return
+		}
+		if req.Host != "" && net.ParseIP(req.Host) == nil {
+			writeError(w, http.StatusBadRequest, "invalid host %s", req.Host)
+			return
+		}
+		if err := validateFallback(req.Fallback); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid fallback: %s", err)
+			return
+		}
+		ttl, err := time.ParseDuration(req.TTL)
+		if err != nil || ttl <= 0 {
+			writeError(w, http.StatusBadRequest, "a positive ttl is required, eg 30m")
+			return
+		}
+		glog.Infof("Adding temporary override for %s for %s: host %q tier %q", mac, ttl, req.Host, req.Tier)
+		s.admin.setOverride(mac.String(), Override{Host: req.Host, Tier: req.Tier, Fallback: req.Fallback}, ttl)
+		writeJSON(w, http.StatusOK, map[string]string{"mac": mac.String()})
+	case http.MethodDelete:
+		mac, err := net.ParseMAC(r.URL.Query().Get("mac"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid mac: %s", err)
+			return
+		}
+		if !s.admin.deleteOverride(mac.String()) {
+			writeError(w, http.StatusNotFound, "no temporary override for %s", mac)
+			return
+		}
+		glog.Infof("Removed temporary override for %s", mac)
+		writeJSON(w, http.StatusOK, map[string]string{"mac": mac.String()})
+	}
+}
+
+func (s *Server) adminThrottle(w http.ResponseWriter, r *http.Request) {
+	if !s.allowed(w, r, http.MethodGet) {
+		return
+	}
+	tokens, rate := s.throttle.tokens()
+	config := s.GetConfig()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"rate":       rate,
+		"cache_size": config.CacheSize,
+		"cache_rate": config.CacheRate,
+		"tokens":     tokens,
+	})
+}
+
+// drainRequest is the body of POST /drain.
+type drainRequest struct {
+	Address string `json:"address"`
+}
+
+func (s *Server) adminDrain(w http.ResponseWriter, r *http.Request) {
+	if !s.allowed(w, r, http.MethodGet, http.MethodPost, http.MethodDelete) {
+		return
+	}
+	var addr string
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, s.admin.drainedServers())
+		return
+	case http.MethodPost:
+		var req drainRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid request: %s", err)
+			return
+		}
+		addr = req.Address
+	case http.MethodDelete:
+		addr = r.URL.Query().Get("address")
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		writeError(w, http.StatusBadRequest, "invalid address %q", addr)
+		return
+	}
+	drained := r.Method == http.MethodPost
+	if drained {
+		glog.Infof("Draining server %s", ip)
+	} else {
+		glog.Infof("Stopping draining server %s", ip)
+	}
+	s.admin.drain(ip.String(), drained)
+	writeJSON(w, http.StatusOK, s.admin.drainedServers())
+}
@@ -0,0 +1,153 @@
+/**
+ * Copyright (c) Facebook, Inc. and its affiliates.
+ *
+ * This source code is licensed under the MIT license found in the
+ * LICENSE file in the root directory of this source tree.
+ */
+
+package dhcplb
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func adminRequest(t *testing.T, handler http.Handler, method, path, body string) (int, map[string]interface{}) {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	var resp map[string]interface{}
+	if strings.HasPrefix(strings.TrimSpace(rec.Body.String()), "{") {
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("Invalid response %q: %s", rec.Body.String(), err)
+		}
+	}
+	return rec.Code, resp
+}
+
+func TestAdminConfig(t *testing.T) {
+	config := newTestConfig(4, nil)
+	config.Extras = "secret"
+	config.HealthCheck = &HealthCheckConfig{Probe: ProbeDHCP}
+	server := newTestServer(t, config)
+	defer server.conn.Close()
+
+	code, resp := adminRequest(t, server.AdminHandler(), http.MethodGet, "/config", "")
+	if code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", code)
+	}
+	if resp["algorithm"] != "xid" || resp["version"] != float64(4) {
+		t.Fatalf("Unexpected config %v", resp)
+	}
+	if _, ok := resp["extras"]; ok {
+		t.Fatalf("Extras must not be exposed")
+	}
+	if hc, _ := resp["health_check"].(map[string]interface{}); hc["relay_addr"] != "" {
+		t.Fatalf("Unset relay_addr should be left empty, got %v", hc["relay_addr"])
+	}
+	if code, _ = adminRequest(t, server.AdminHandler(), http.MethodPost, "/config", ""); code != http.StatusMethodNotAllowed {
+		t.Fatalf("Expected status 405, got %d", code)
+	}
+}
+
+func TestAdminWritesDisabled(t *testing.T) {
+	server := newTestServer(t, newTestConfig(4, nil))
+	defer server.conn.Close()
+
+	code, _ := adminRequest(t, server.AdminHandler(), http.MethodPost, "/drain", `{"address": "10.0.0.1"}`)
+	if code != http.StatusForbidden {
+		t.Fatalf("Expected status 403, got %d", code)
+	}
+	if server.admin.isDrained(NewDHCPServer("", net.ParseIP("10.0.0.1"), 67)) {
+		t.Fatalf("Server drained while writes are disabled")
+	}
+}
+
+func TestAdminTemporaryOverride(t *testing.T) {
+	config := newTestConfig(4, []*DHCPServer{NewDHCPServer("a", net.ParseIP("10.0.0.1"), 67)})
+	config.AdminWrites = true
+	server := newTestServer(t, config)
+	defer server.conn.Close()
+	mac := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+	message := &DHCPMessage{XID: []byte{1, 2, 3, 4}, Mac: mac, ClientID: mac}
+
+	for _, body := range []string{
+		`{"mac": "invalid", "host": "10.0.0.2", "ttl": "1h"}`,
+		`{"mac": "aa:bb:cc:dd:ee:ff", "ttl": "1h"}`,
+		`{"mac": "aa:bb:cc:dd:ee:ff", "host": "10.0.0.2"}`,
+	} {
+		if code, _ := adminRequest(t, server.AdminHandler(), http.MethodPost, "/overrides", body); code != http.StatusBadRequest {
+			t.Fatalf("Expected status 400 for %s, got %d", body, code)
+		}
+	}
+
+	code, _ := adminRequest(t, server.AdminHandler(), http.MethodPost, "/overrides",
+		`{"mac": "AA:BB:CC:DD:EE:FF", "host": "10.0.0.2", "ttl": "1h"}`)
+	if code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", code)
+	}
+	selected, err := server.selectDestinationServer(time.Now(), config, message)
+	if err != nil {
+		t.Fatalf("Failed to select server: %s", err)
+	}
+	if !selected.Address.Equal(net.ParseIP("10.0.0.2")) {
+		t.Fatalf("Expected the temporary override to be used, got %s", selected)
+	}
+
+	_, resp := adminRequest(t, server.AdminHandler(), http.MethodGet, "/overrides", "")
+	if override, ok := resp[mac.String()].(map[string]interface{}); !ok || override["temporary"] != true {
+		t.Fatalf("Expected a temporary override for %s, got %v", mac, resp)
+	}
+
+	code, _ = adminRequest(t, server.AdminHandler(), http.MethodDelete, "/overrides?mac="+mac.String(), "")
+	if code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", code)
+	}
+	if selected, _ = server.selectDestinationServer(time.Now(), config, message); !selected.Address.Equal(net.ParseIP("10.0.0.1")) {
+		t.Fatalf("Expected the override to be removed, got %s", selected)
+	}
+
+	// expired overrides are ignored
+	server.admin.setOverride(mac.String(), Override{Host: "10.0.0.2"}, time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	if selected, _ = server.selectDestinationServer(time.Now(), config, message); !selected.Address.Equal(net.ParseIP("10.0.0.1")) {
+		t.Fatalf("Expected the expired override to be ignored, got %s", selected)
+	}
+}
+
+func TestAdminDrain(t *testing.T) {
+	config := newTestConfig(6, nil)
+	config.AdminWrites = true
+	server := newTestServer(t, config)
+	defer server.conn.Close()
+	backend := NewDHCPServer("a", net.ParseIP("2001:db8::1"), 547)
+
+	code, _ := adminRequest(t, server.AdminHandler(), http.MethodPost, "/drain", `{"address": "2001:db8::1"}`)
+	if code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", code)
+	}
+	if marked := server.markDraining([]*DHCPServer{backend}); !marked[0].Draining {
+		t.Fatalf("Drained server not marked as draining")
+	}
+	if backend.Draining {
+		t.Fatalf("Servers from the sourcer must not be modified")
+	}
+	select {
+	case <-server.admin.changed:
+	default:
+		t.Fatalf("Draining a server should trigger a server list update")
+	}
+
+	code, _ = adminRequest(t, server.AdminHandler(), http.MethodDelete, "/drain?address=2001:db8::1", "")
+	if code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", code)
+	}
+	if marked := server.markDraining([]*DHCPServer{backend}); marked[0].Draining {
+		t.Fatalf("Server still draining")
+	}
+}
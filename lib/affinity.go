@@ -0,0 +1,94 @@
+/**
+ * Copyright (c) Facebook, Inc. and its affiliates.
+ *
+ * This source code is licensed under the MIT license found in the
+ * LICENSE file in the root directory of this source tree.
+ */
+
+package dhcplb
+
+import (
+	"github.com/golang/glog"
+	lru "github.com/hashicorp/golang-lru/v2"
+)
+
+// defaultAffinitySize is the number of clients remembered by the affinity
+// table when not specified in the config.
+const defaultAffinitySize = 65536
+
+// affinityTable remembers which server each client was last sent to, so that
+// draining servers keep getting the clients they already served. It's an LRU
+// to bound memory usage, evicted clients are treated as new ones.
+type affinityTable struct {
+	cache *lru.Cache[string, serverKey]
+}
+
+func newAffinityTable(size int) (*affinityTable, error) {
+	cache, err := lru.New[string, serverKey](size)
+	if err != nil {
+		return nil, err
+	}
+	return &affinityTable{cache: cache}, nil
+}
+
+// record remembers that the client was sent to server.
+func (a *affinityTable) record(clientID []byte, server *DHCPServer) {
+	a.cache.Add(string(clientID), keyFor(server))
+}
+
+// servedBy returns true if the client was last sent to server.
+func (a *affinityTable) servedBy(clientID []byte, server *DHCPServer) bool {
+	key, ok := a.cache.Peek(string(clientID))
+	return ok && key == keyFor(server)
+}
+
+func (a *affinityTable) resize(size int) {
+	if evicted := a.cache.Resize(size); evicted > 0 {
+		glog.Infof("Affinity table resized to %d clients, %d evicted", size, evicted)
+	}
+}
+
+// steer sends the clients selected for a draining server to the other servers
+// of the same list, unless the draining server handled them before.
+func (s *Server) steer(config *Config, server *DHCPServer, message *DHCPMessage) *DHCPServer {
+	if !server.Draining || s.affinity.servedBy(message.ClientID, server) {
+		return server
+	}
+	stable, rc := s.serverLists()
+	list := stable
+	if server.IsRC {
+		list = rc
+	}
+	candidates := make([]*DHCPServer, 0, len(list))
+	for _, candidate := range list {
+		if !candidate.Draining {
+			candidates = append(candidates, candidate)
+		}
+	}
+	if len(candidates) == 0 {
+		glog.Errorf("All servers are draining, sending new client %x to %s anyway", message.ClientID, server.Hostname)
+		return server
+	}
+	steered, err := config.Algorithm.SelectServerFromList(candidates, message)
+	if err != nil {
+		glog.Errorf("Failed to steer new client %x away from draining server %s: %s", message.ClientID, server.Hostname, err)
+		return server
+	}
+	glog.V(2).Infof("Server %s is draining, sending new client %x to %s", server.Hostname, message.ClientID, steered.Hostname)
+	return steered
+}
+
+// markDraining returns list with the servers drained through the admin API
+// marked as draining. They are copied, as sourcers may share them.
+func (s *Server) markDraining(list []*DHCPServer) []*DHCPServer {
+	marked := make([]*DHCPServer, 0, len(list))
+	for _, server := range list {
+		if !server.Draining && s.admin.isDrained(server) {
+			drained := *server
+			drained.Draining = true
+			server = &drained
+		}
+		marked = append(marked, server)
+	}
+	return marked
+}
@@ -0,0 +1,80 @@
+/**
+ * Copyright (c) Facebook, Inc. and its affiliates.
+ *
+ * This source code is licensed under the MIT license found in the
+ * LICENSE file in the root directory of this source tree.
+ */
+
+package dhcplb
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAffinityTable(t *testing.T) {
+	a := NewDHCPServer("a", net.ParseIP("10.0.0.1"), 67)
+	b := NewDHCPServer("b", net.ParseIP("10.0.0.2"), 67)
+	table, err := newAffinityTable(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table.record([]byte{1}, a)
+	table.record([]byte{2}, b)
+	if !table.servedBy([]byte{1}, a) || table.servedBy([]byte{1}, b) {
+		t.Fatalf("Client 1 should only be served by a")
+	}
+	// the least recently used client is evicted
+	table.record([]byte{3}, b)
+	if table.servedBy([]byte{1}, a) {
+		t.Fatalf("Client 1 should have been evicted")
+	}
+	table.resize(1)
+	if table.servedBy([]byte{2}, b) || !table.servedBy([]byte{3}, b) {
+		t.Fatalf("Only client 3 should be left after resizing")
+	}
+}
+
+func TestDrainingSteersNewClients(t *testing.T) {
+	a := NewDHCPServer("a", net.ParseIP("10.0.0.1"), 67)
+	b := NewDHCPServer("b", net.ParseIP("10.0.0.2"), 67)
+	config := newTestConfig(4, []*DHCPServer{a, b})
+	config.AffinitySize = 1024
+	server := newTestServer(t, config)
+	defer server.conn.Close()
+	server.stableServers = []*DHCPServer{a, b}
+
+	// send clients while nothing is draining
+	clients := make(map[string]*DHCPServer)
+	for i := 0; i < 100; i++ {
+		mac := net.HardwareAddr{0, 0, 0, 0, 0, byte(i)}
+		selected, err := server.selectDestinationServer(time.Now(), config, &DHCPMessage{Mac: mac, ClientID: mac})
+		if err != nil {
+			t.Fatal(err)
+		}
+		clients[mac.String()] = selected
+	}
+
+	// then drain b
+	drainingB := *b
+	drainingB.Draining = true
+	servers := []*DHCPServer{a, &drainingB}
+	config.Algorithm.UpdateStableServerList(servers)
+	server.stableServers = servers
+
+	for i := 0; i < 200; i++ {
+		mac := net.HardwareAddr{0, 0, 0, 0, 0, byte(i)}
+		selected, err := server.selectDestinationServer(time.Now(), config, &DHCPMessage{Mac: mac, ClientID: mac})
+		if err != nil {
+			t.Fatal(err)
+		}
+		previous, known := clients[mac.String()]
+		if known && keyFor(previous) != keyFor(selected) {
+			t.Errorf("Known client %s moved from %s to %s", mac, previous.Hostname, selected.Hostname)
+		}
+		if !known && selected.Hostname != "a" {
+			t.Errorf("New client %s sent to draining server %s", mac, selected.Hostname)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+/**
+ * Copyright (c) Facebook, Inc. and its affiliates.
+ *
+ * This source code is licensed under the MIT license found in the
+ * LICENSE file in the root directory of this source tree.
+ */
+
+package dhcplb
+
+import (
+	"context"
+	"io"
+	"net"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// batchConn reads and writes several packets with a single syscall
+// (recvmmsg/sendmmsg on Linux, one packet at a time elsewhere). It's
+// implemented by both ipv4.PacketConn and ipv6.PacketConn, whose Message
+// types are the same.
+type batchConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+func newBatchConn(conn *net.UDPConn, version int) batchConn {
+	if version == 4 {
+		return ipv4.NewPacketConn(conn)
+	}
+	return ipv6.NewPacketConn(conn)
+}
+
+// readBatches is the read loop used when Config.BatchSize is set, it reads up
+// to size packets at a time from conn.
+func (s *Server) readBatches(ctx context.Context, conn *net.UDPConn, size int) {
+	bc := newBatchConn(conn, s.config.Version)
+	msgs := make([]ipv4.Message, size)
+	buffers := make([]*[]byte, size)
+	for i := range msgs {
+		buffers[i] = s.getBuffer()
+		msgs[i].Buffers = [][]byte{*buffers[i]}
+	}
+	defer func() {
+		for _, buffer := range buffers {
+			s.putBuffer(buffer)
+		}
+	}()
+	for !s.isStopping() {
+		n, err := bc.ReadBatch(msgs, 0)
+		if s.isStopping() {
+			// the read deadline was set because we are shutting down
+			return
+		}
+		if err != nil {
+			glog.Errorf("error reading batch from %s: %v", conn.LocalAddr(), err)
+			s.logger.LogErr(time.Now(), nil, nil, nil, ErrRead, err)
+			continue
+		}
+		for i := range msgs[:n] {
+			peer, _ := msgs[i].Addr.(*net.UDPAddr)
+			if msgs[i].N == 0 {
+				glog.Errorf("error reading from %s: empty packet", peer)
+				s.logger.LogErr(time.Now(), nil, nil, peer, ErrRead, io.ErrUnexpectedEOF)
+				continue
+			}
+			*buffers[i] = (*buffers[i])[:msgs[i].N]
+			s.dispatch(ctx, buffers[i], peer)
+			// the buffer is now owned by the handler
+			buffers[i] = s.getBuffer()
+			msgs[i].Buffers[0] = *buffers[i]
+		}
+	}
+}
+
+// outgoingPacket is a packet waiting to be sent by a batchWriter.
+type outgoingPacket struct {
+	buffer []byte
+	addr   *net.UDPAddr
+	err    chan error
+}
+
+// batchWriter collects the packets sent concurrently by the handlers and
+// writes them with as few syscalls as possible.
+type batchWriter struct {
+	conn  batchConn
+	queue chan *outgoingPacket
+	size  int
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+func newBatchWriter(conn *net.UDPConn, version int, size int) *batchWriter {
+	return &batchWriter{
+		conn:  newBatchConn(conn, version),
+		queue: make(chan *outgoingPacket, size),
+		size:  size,
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+}
+
+// write queues a packet and waits until it's been sent.
+func (w *batchWriter) write(buffer []byte, addr *net.UDPAddr) error {
+	packet := &outgoingPacket{buffer: buffer, addr: addr, err: make(chan error, 1)}
+	select {
+	case w.queue <- packet:
+	case <-w.done:
+		return net.ErrClosed
+	}
+	select {
+	case err := <-packet.err:
+		return err
+	case <-w.done:
+		return net.ErrClosed
+	}
+}
+
+// run sends the queued packets until close is called. Packets are written as
+// soon as they are available, a batch only holds the packets which were
+// queued while the previous one was being written.
+func (w *batchWriter) run() {
+	defer close(w.done)
+	batch := make([]*outgoingPacket, 0, w.size)
+	msgs := make([]ipv4.Message, w.size)
+	for i := range msgs {
+		msgs[i].Buffers = make([][]byte, 1)
+	}
+	for {
+		select {
+		case packet := <-w.queue:
+			batch = append(batch[:0], packet)
+		case <-w.stop:
+			return
+		}
+	fill:
+		for len(batch) < w.size {
+			select {
+			case packet := <-w.queue:
+				batch = append(batch, packet)
+			default:
+				break fill
+			}
+		}
+		w.flush(batch, msgs)
+	}
+}
+
+// close stops the writer once the packets being handled were sent, the
+// packets written afterwards fail with net.ErrClosed.
+func (w *batchWriter) close() {
+	close(w.stop)
+	<-w.done
+}
+
+func (w *batchWriter) flush(batch []*outgoingPacket, msgs []ipv4.Message) {
+	for i, packet := range batch {
+		msgs[i].Buffers[0] = packet.buffer
+		msgs[i].Addr = packet.addr
+	}
+	for sent := 0; sent < len(batch); {
+		n, err := w.conn.WriteBatch(msgs[sent:len(batch)], 0)
+		if err == nil && n == 0 {
+			err = io.ErrShortWrite
+		}
+		if err != nil {
+			// blame the first packet which wasn't sent and retry with the
+			// following ones
+			batch[sent].err <- err
+			sent++
+			continue
+		}
+		for _, packet := range batch[sent : sent+n] {
+			packet.err <- nil
+		}
+		sent += n
+	}
+}
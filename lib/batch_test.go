@@ -0,0 +1,157 @@
+/**
+ * Copyright (c) Facebook, Inc. and its affiliates.
+ *
+ * This source code is licensed under the MIT license found in the
+ * LICENSE file in the root directory of this source tree.
+ */
+
+package dhcplb
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"golang.org/x/net/ipv6"
+)
+
+// testBackend is a loopback stand-in for a DHCP server which counts the
+// packets it receives.
+type testBackend struct {
+	conn     *net.UDPConn
+	received int64
+	notify   chan struct{}
+}
+
+func newTestBackend(t testing.TB, version int) *testBackend {
+	network, ip := "udp4", net.ParseIP("127.0.0.1")
+	if version == 6 {
+		network, ip = "udp6", net.IPv6loopback
+	}
+	conn, err := net.ListenUDP(network, &net.UDPAddr{IP: ip})
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	b := &testBackend{conn: conn, notify: make(chan struct{}, 1)}
+	go func() {
+		buffer := make([]byte, 1500)
+		for {
+			if _, _, err := conn.ReadFromUDP(buffer); err != nil {
+				return
+			}
+			atomic.AddInt64(&b.received, 1)
+			select {
+			case b.notify <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return b
+}
+
+func (b *testBackend) server() *DHCPServer {
+	addr := b.conn.LocalAddr().(*net.UDPAddr)
+	return NewDHCPServer("backend", addr.IP, addr.Port)
+}
+
+// wait waits until the backend received at least n packets, it returns false
+// if nothing was received for a second.
+func (b *testBackend) wait(n int64) bool {
+	for atomic.LoadInt64(&b.received) < n {
+		select {
+		case <-b.notify:
+		case <-time.After(time.Second):
+			return false
+		}
+	}
+	return true
+}
+
+func newTestSolicit(t testing.TB) []byte {
+	solicit, err := dhcpv6.NewSolicit(net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff})
+	if err != nil {
+		t.Fatalf("Failed to create solicit: %s", err)
+	}
+	return solicit.ToBytes()
+}
+
+func TestBatchRelayV6(t *testing.T) {
+	backend := newTestBackend(t, 6)
+	defer backend.conn.Close()
+	config := newTestConfig(6, []*DHCPServer{backend.server()})
+	config.BatchSize = 8
+	server := newTestServer(t, config)
+	stop := serve(t, server)
+	defer stop()
+
+	client, err := net.DialUDP("udp6", nil, server.conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("Failed to dial: %s", err)
+	}
+	defer client.Close()
+	solicit := newTestSolicit(t)
+	for i := 0; i < 20; i++ {
+		if _, err := client.Write(solicit); err != nil {
+			t.Fatalf("Failed to send: %s", err)
+		}
+	}
+	if !backend.wait(20) {
+		t.Fatalf("Expected 20 packets to be relayed, got %d", atomic.LoadInt64(&backend.received))
+	}
+}
+
+// BenchmarkRelayV6 measures the throughput of the v6 relay path, with and
+// without batched I/O.
+func BenchmarkRelayV6(b *testing.B) {
+	for _, batchSize := range []int{0, 64} {
+		b.Run(fmt.Sprintf("batch_size=%d", batchSize), func(b *testing.B) {
+			backend := newTestBackend(b, 6)
+			defer backend.conn.Close()
+			config := newTestConfig(6, []*DHCPServer{backend.server()})
+			config.BatchSize = batchSize
+			config.PacketBufSize = 1024
+			server := newTestServer(b, config)
+			stop := serve(b, server)
+			defer stop()
+
+			client, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+			if err != nil {
+				b.Fatalf("Failed to listen: %s", err)
+			}
+			defer client.Close()
+
+			// send bursts of packets, waiting for each one to be relayed so
+			// that the socket buffers don't overflow
+			const burst = 64
+			solicit := newTestSolicit(b)
+			msgs := make([]ipv6.Message, burst)
+			for i := range msgs {
+				msgs[i].Buffers = [][]byte{solicit}
+				msgs[i].Addr = server.conn.LocalAddr()
+			}
+			pc := ipv6.NewPacketConn(client)
+			b.ResetTimer()
+			for sent := 0; sent < b.N; {
+				n := b.N - sent
+				if n > burst {
+					n = burst
+				}
+				for written := 0; written < n; {
+					w, err := pc.WriteBatch(msgs[written:n], 0)
+					if err != nil {
+						b.Fatalf("Failed to send: %s", err)
+					}
+					written += w
+				}
+				sent += n
+				backend.wait(int64(sent))
+			}
+			backend.wait(int64(b.N))
+			b.StopTimer()
+			b.ReportMetric(float64(int64(b.N)-atomic.LoadInt64(&backend.received)), "dropped")
+		})
+	}
+}
@@ -8,12 +8,17 @@
 package dhcplb
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
@@ -47,46 +52,129 @@ type Config struct {
 	CacheRate            int
 	Rate                 int
 	ReplyAddr            *net.UDPAddr
+	HealthCheck          *HealthCheckConfig
+	ReplyTracking        *ReplyTrackingConfig
+	ShutdownTimeout      time.Duration
+	WorkerPool           *WorkerPoolConfig
+	ListenSockets        int
+	BatchSize            int
+	AdminWrites          bool
+	AffinitySize         int
+	RelayTableSize       int
+	RelayAgentInfo       *RelayAgentInfoConfig
+	MaxHops              int
+	ZeroGiaddr           string
+	Giaddr               net.IP
+	RewriteGiaddr        bool
+	RelaySubnets         []*net.IPNet
+	RelayOptions         *RelayOptionsConfig
+	// the overrides which are currently active, indexed by the kind of key
+	// they match
+	activeOverrides *overrideSchedule
+	// the config fields set by config layers instead of the config file, and
+	// the name of the layer they come from
+	sources map[string]string
 }
 
+// defaultShutdownTimeout is how long to wait for in-flight packets when
+// shutting down, if not specified in the config.
+const defaultShutdownTimeout = 5 * time.Second
+
 // Override represents the dhcp server or the group of dhcp servers (tier) we
 // want to send packets to.
 type Override struct {
 	// note that Host override takes precedence over Tier
-	Host       string `json:"host"`
-	Tier       string `json:"tier"`
+	Host string `json:"host"`
+	Tier string `json:"tier"`
+	// optional timestamps, the override only applies between them
+	Start      string `json:"start"`
 	Expiration string `json:"expiration"`
+	// what to do when the host or tier is unavailable, see the Fallback
+	// constants
+	Fallback string `json:"fallback"`
+	// Start and Expiration, parsed by parseOverrides
+	startTime      time.Time
+	expirationTime time.Time
 }
 
+// Fallback policies of overrides. An alternate tier is given as "tier:" followed
+// by the name of the tier.
+const (
+	// FallbackDrop drops the packet, this is the default
+	FallbackDrop = "drop"
+	// FallbackDefault sends the packet to the server picked by the balancing
+	// algorithm, as if there was no override
+	FallbackDefault = "default"
+	// FallbackTierPrefix prefixes the name of the tier to send the packet to
+	FallbackTierPrefix = "tier:"
+)
+
+// legacyTimeFormat is the format of override timestamps accepted besides
+// RFC 3339, eg "2017/05/06 14:00 +0000".
+const legacyTimeFormat = "2006/01/02 15:04 -0700"
+
 // Overrides is a struct that holds v4 and v6 list of overrides.
-// The keys of the map are mac addresses.
+// The keys of the map are mac addresses, or DUIDs, vendor serials, vendor
+// classes and relay subnets prefixed by "duid:", "serial:", "vendor_class:"
+// and "subnet:".
 type Overrides struct {
 	V4 map[string]Override `json:"v4"`
 	V6 map[string]Override `json:"v6"`
 }
 
-// LoadConfig will take the path of the json file, the path of the override json
+// LoadConfig will take the path of the config file, the path of the override
 // file, an integer version and a ConfigProvider and will return a pointer to
-// a Config object.
+// a Config object. The files can be JSON, or YAML and TOML if their names end
+// in .yaml/.yml and .toml.
 func LoadConfig(path, overridesPath string, version int, provider ConfigProvider) (*Config, error) {
-	file, err := os.ReadFile(path)
+	file, overridesFile, err := readConfigFiles(path, overridesPath)
 	if err != nil {
 		return nil, err
 	}
+	return ParseConfig(file, overridesFile, version, provider)
+}
 
-	overridesFile := []byte{}
-	// path length of 0 means we aren't using overrides
-	if len(overridesPath) != 0 {
-		if overridesFile, err = os.ReadFile(overridesPath); err != nil {
-			return nil, err
-		}
+// ValidateConfigFiles is like ValidateConfig, but reads the files from disk
+// in any of the formats supported by LoadConfig.
+func ValidateConfigFiles(path, overridesPath string, version int, provider ConfigProvider) []error {
+	file, overridesFile, err := readConfigFiles(path, overridesPath)
+	if err != nil {
+		return []error{err}
 	}
-	return ParseConfig(file, overridesFile, version, provider)
+	return ValidateConfig(file, overridesFile, version, provider)
 }
 
 // ParseConfig will take JSON config files, a version and a ConfigProvider,
-// and return a pointer to a Config struct
+// and return a pointer to a Config struct. If the files are invalid the
+// returned error lists all the problems found.
 func ParseConfig(jsonConfig, jsonOverrides []byte, version int, provider ConfigProvider) (*Config, error) {
+	return parseConfig(jsonConfig, jsonOverrides, version, provider, false)
+}
+
+// ValidateConfig parses JSON config files like ParseConfig, and also checks
+// the host lists if the sourcer implements DHCPServerSourcerValidator and the
+// override keys ParseConfig ignores. It returns all the problems found,
+// without keeping the sourcer around.
+func ValidateConfig(jsonConfig, jsonOverrides []byte, version int, provider ConfigProvider) []error {
+	var errs []error
+	config, err := parseConfig(jsonConfig, jsonOverrides, version, provider, true)
+	if list, ok := err.(errorList); ok {
+		errs = list
+	} else if err != nil {
+		errs = []error{err}
+	} else {
+		closeSourcer(config.HostSourcer)
+	}
+	if len(jsonOverrides) != 0 {
+		// the problems of the overrides file itself were reported above
+		if overrides, _ := parseOverrides(jsonOverrides, version); overrides != nil {
+			errs = append(errs, unknownOverrideKeys(overrides)...)
+		}
+	}
+	return errs
+}
+
+func parseConfig(jsonConfig, jsonOverrides []byte, version int, provider ConfigProvider, validateSourcer bool) (*Config, error) {
 	var combined combinedconfigSpec
 	if err := json.Unmarshal(jsonConfig, &combined); err != nil {
 		glog.Errorf("Failed to parse JSON: %s", err)
@@ -99,29 +187,98 @@ func ParseConfig(jsonConfig, jsonOverrides []byte, version int, provider ConfigP
 		spec = combined.V6
 	}
 
-	var overrides map[string]Override
-	if len(jsonOverrides) == 0 {
-		overrides = make(map[string]Override)
-	} else {
-		var err error
+	var errs errorList
+	sources, err := applyConfigLayers(&spec, version)
+	errs = errs.add(err)
+	overrides := make(map[string]Override)
+	if len(jsonOverrides) != 0 {
 		overrides, err = parseOverrides(jsonOverrides, version)
 		if err != nil {
 			glog.Errorf("Failed to load overrides: %s", err)
-			return nil, err
+			errs = errs.add(err)
+			// keep going with the valid overrides to report the problems
+			// of the config too
+			if overrides == nil {
+				overrides = make(map[string]Override)
+			}
 		}
 	}
 	glog.Infof("Loaded %d override(s)", len(overrides))
-	return newConfig(&spec, overrides, provider)
+	config, err := newConfig(&spec, overrides, provider, validateSourcer)
+	errs = errs.add(err)
+	if len(errs) > 0 {
+		if config != nil {
+			closeSourcer(config.HostSourcer)
+		}
+		return nil, errs
+	}
+	config.sources = sources
+	return config, nil
+}
+
+// errorList holds all the problems found in a config.
+type errorList []error
+
+// add appends err to the list, if it's not nil.
+func (l errorList) add(err error) errorList {
+	if err == nil {
+		return l
+	}
+	if errs, ok := err.(errorList); ok {
+		return append(l, errs...)
+	}
+	return append(l, err)
+}
+
+func (l errorList) Error() string {
+	msgs := make([]string, 0, len(l))
+	for _, err := range l {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// closeSourcer stops the sourcer of a config which won't be used.
+func closeSourcer(sourcer DHCPServerSourcer) {
+	if closer, ok := sourcer.(io.Closer); ok {
+		closer.Close()
+	}
 }
 
 // WatchConfig will keep watching for changes to both config and override json
 // files. It uses fsnotify library (it uses inotify in Linux), and call
 // LoadConfig when it an inotify event signals the modification of the json
-// files.
+// files. Configs failing to load are logged and not sent, so that the previous
+// one stays in use.
 func WatchConfig(
 	configPath, overridesPath string, version int, provider ConfigProvider,
 ) (chan *Config, error) {
-	configChan := make(chan *Config)
+	return WatchConfigContext(context.Background(), configPath, overridesPath, version, provider)
+}
+
+// WatchConfigContext is like WatchConfig, watching stops and the returned
+// channel is closed when ctx is cancelled.
+func WatchConfigContext(
+	ctx context.Context, configPath, overridesPath string, version int, provider ConfigProvider,
+) (chan *Config, error) {
+	configChans, err := WatchConfigs(ctx, configPath, overridesPath, []int{version}, provider)
+	if err != nil {
+		return nil, err
+	}
+	return configChans[version], nil
+}
+
+// WatchConfigs is like WatchConfig for several versions served by the same
+// process, sharing a single watcher. Each version is reloaded independently,
+// when its section of the config or overrides file changed, and has its own
+// channel.
+func WatchConfigs(
+	ctx context.Context, configPath, overridesPath string, versions []int, provider ConfigProvider,
+) (map[int]chan *Config, error) {
+	configChans := make(map[int]chan *Config, len(versions))
+	for _, version := range versions {
+		configChans[version] = make(chan *Config)
+	}
 
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
@@ -163,8 +320,20 @@ func WatchConfig(
 
 	// watch for fsnotify events
 	go func() {
+		defer func() {
+			for _, configChan := range configChans {
+				close(configChan)
+			}
+		}()
+		defer watcher.Close()
+		// the sections of the files each version was last loaded from, and
+		// the versions whose last reload failed
+		loaded := make(map[int][]byte)
+		failing := make(map[int]bool)
 		for {
 			select {
+			case <-ctx.Done():
+				return
 			case ev := <-watcher.Events:
 				// ignore Remove events
 				if ev.Op&fsnotify.Remove == fsnotify.Remove {
@@ -174,13 +343,38 @@ func WatchConfig(
 				if ev.Name == overridesPath || ev.Name == configPath ||
 					ev.Name == realOverridesPath || ev.Name == realConfigPath {
 					glog.Infof("Configuration file changed (%s), reloading", ev)
-					config, err := LoadConfig(
-						configPath, overridesPath, version, provider)
-					if err != nil {
-						glog.Fatalf("Failed to reload config: %s", err)
-						panic(err) // fail hard
+					file, overridesFile, readErr := readConfigFiles(configPath, overridesPath)
+					for _, version := range versions {
+						section := configSection(file, overridesFile, version)
+						if readErr == nil && section != nil && bytes.Equal(section, loaded[version]) {
+							glog.Infof("v%d configuration didn't change", version)
+							if failing[version] {
+								// the file went back to the config in use
+								recordReload(version, nil)
+								failing[version] = false
+							}
+							continue
+						}
+						var config *Config
+						err := readErr
+						if err == nil {
+							config, err = ParseConfig(file, overridesFile, version, provider)
+						}
+						recordReload(version, err)
+						failing[version] = err != nil
+						if err != nil {
+							// keep serving with the previous config, the next
+							// change will be tried again
+							glog.Errorf("Failed to reload v%d config, keeping the previous one: %s", version, err)
+							continue
+						}
+						loaded[version] = section
+						select {
+						case configChans[version] <- config:
+						case <-ctx.Done():
+							return
+						}
 					}
-					configChan <- config
 				}
 			case err := <-watcher.Errors:
 				glog.Errorf("fsnotify error: %s", err)
@@ -188,25 +382,148 @@ func WatchConfig(
 		}
 	}()
 
-	return configChan, nil
+	return configChans, nil
+}
+
+// readConfigFiles reads the config file, and the overrides file if its path
+// isn't empty, and converts them to JSON.
+func readConfigFiles(path, overridesPath string) ([]byte, []byte, error) {
+	file, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if file, err = toJSON(path, file); err != nil {
+		return nil, nil, err
+	}
+	overridesFile := []byte{}
+	// path length of 0 means we aren't using overrides
+	if len(overridesPath) != 0 {
+		if overridesFile, err = os.ReadFile(overridesPath); err != nil {
+			return nil, nil, err
+		}
+		if overridesFile, err = toJSON(overridesPath, overridesFile); err != nil {
+			return nil, nil, err
+		}
+	}
+	return file, overridesFile, nil
+}
+
+// configSection returns the sections of the config and overrides files used by
+// version, or nil if they can't be parsed.
+func configSection(file, overridesFile []byte, version int) []byte {
+	key := fmt.Sprintf("v%d", version)
+	var sections map[string]json.RawMessage
+	if err := json.Unmarshal(file, &sections); err != nil {
+		return nil
+	}
+	section := append([]byte{}, sections[key]...)
+	// separate the sections so that moving bytes across them is a change
+	section = append(section, 0)
+	if len(overridesFile) == 0 {
+		return section
+	}
+	sections = nil
+	if err := json.Unmarshal(overridesFile, &sections); err != nil {
+		return nil
+	}
+	return append(section, sections[key]...)
+}
+
+// ReloadStatus is the outcome of the configuration reloads of a version.
+type ReloadStatus struct {
+	LastAttempt         time.Time `json:"last_attempt"`
+	LastSuccess         time.Time `json:"last_success"`
+	LastError           string    `json:"last_error,omitempty"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+}
+
+var (
+	reloadLock     sync.Mutex
+	reloadStatuses = make(map[int]ReloadStatus)
+)
+
+// recordReload keeps track of the outcome of a reload for the metrics and the
+// admin API.
+func recordReload(version int, err error) {
+	recordConfigReload(version, err)
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+	status := reloadStatuses[version]
+	status.LastAttempt = time.Now()
+	if err != nil {
+		status.LastError = err.Error()
+		status.ConsecutiveFailures++
+	} else {
+		status.LastSuccess = status.LastAttempt
+		status.LastError = ""
+		status.ConsecutiveFailures = 0
+	}
+	reloadStatuses[version] = status
+}
+
+// GetReloadStatus returns the outcome of the configuration reloads of
+// version done by WatchConfig.
+func GetReloadStatus(version int) ReloadStatus {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+	return reloadStatuses[version]
 }
 
 // configSpec holds the raw json configuration.
 type configSpec struct {
 	Path                 string
-	Version              int             `json:"version"`
-	ListenAddr           string          `json:"listen_addr"`
-	Port                 int             `json:"port"`
-	AlgorithmName        string          `json:"algorithm"`
-	UpdateServerInterval int             `json:"update_server_interval"`
-	PacketBufSize        int             `json:"packet_buf_size"`
-	HostSourcer          string          `json:"host_sourcer"`
-	RCRatio              uint32          `json:"rc_ratio"`
-	Extras               json.RawMessage `json:"extras"`
-	CacheSize            int             `json:"throttle_cache_size"`
-	CacheRate            int             `json:"throttle_cache_rate"`
-	Rate                 int             `json:"throttle_rate"`
-	ReplyAddr            string          `json:"reply_addr"`
+	Version              int                 `json:"version"`
+	ListenAddr           string              `json:"listen_addr"`
+	Port                 int                 `json:"port"`
+	AlgorithmName        string              `json:"algorithm"`
+	VirtualNodes         int                 `json:"virtual_nodes"`
+	UpdateServerInterval int                 `json:"update_server_interval"`
+	PacketBufSize        int                 `json:"packet_buf_size"`
+	HostSourcer          string              `json:"host_sourcer"`
+	RCRatio              uint32              `json:"rc_ratio"`
+	Extras               json.RawMessage     `json:"extras"`
+	CacheSize            int                 `json:"throttle_cache_size"`
+	CacheRate            int                 `json:"throttle_cache_rate"`
+	Rate                 int                 `json:"throttle_rate"`
+	ReplyAddr            string              `json:"reply_addr"`
+	HealthCheck          *healthCheckSpec    `json:"health_check"`
+	ReplyTracking        *replyTrackingSpec  `json:"reply_tracking"`
+	ShutdownTimeout      int                 `json:"shutdown_timeout"`
+	ListenSockets        int                 `json:"listen_sockets"`
+	Workers              int                 `json:"workers"`
+	QueueSize            int                 `json:"queue_size"`
+	DropPolicy           string              `json:"drop_policy"`
+	BatchSize            int                 `json:"batch_size"`
+	AdminWrites          bool                `json:"admin_writes"`
+	AffinitySize         int                 `json:"affinity_size"`
+	RelayTableSize       int                 `json:"relay_table_size"`
+	RelayAgentInfo       *relayAgentInfoSpec `json:"relay_agent_info"`
+	MaxHops              int                 `json:"max_hops"`
+	ZeroGiaddr           string              `json:"zero_giaddr"`
+	Giaddr               string              `json:"giaddr"`
+	RelaySubnets         []string            `json:"relay_subnets"`
+	RelayOptions         *relayOptionsSpec   `json:"relay_options"`
+}
+
+// healthCheckSpec holds the raw json configuration of active health checks.
+// Health checks are disabled when the section is missing.
+type healthCheckSpec struct {
+	Interval  int    `json:"interval"`
+	TimeoutMs int    `json:"timeout_ms"`
+	Rise      int    `json:"rise"`
+	Fall      int    `json:"fall"`
+	Probe     string `json:"probe"`
+	RelayAddr string `json:"relay_addr"`
+}
+
+// replyTrackingSpec holds the raw json configuration of passive health
+// tracking. Reply tracking is disabled when the section is missing.
+type replyTrackingSpec struct {
+	Window         int     `json:"window"`
+	HoldDown       int     `json:"hold_down"`
+	ReplyTimeoutMs int     `json:"reply_timeout_ms"`
+	MinRequests    int     `json:"min_requests"`
+	MinReplyRatio  float64 `json:"min_reply_ratio"`
 }
 
 type combinedconfigSpec struct {
@@ -216,7 +533,11 @@ type combinedconfigSpec struct {
 
 func (c *configSpec) sourcer(provider ConfigProvider) (DHCPServerSourcer, error) {
 	// Load the DHCPServerSourcer implementation
-	sourcerInfo := strings.Split(c.HostSourcer, ":")
+	sourcerInfo := strings.SplitN(c.HostSourcer, ":", 2)
+	if len(sourcerInfo) != 2 {
+		return nil, fmt.Errorf(
+			"Invalid host_sourcer '%s', expected <type>:<args>", c.HostSourcer)
+	}
 	sourcerType := sourcerInfo[0]
 	stable := sourcerInfo[1]
 	rc := ""
@@ -233,9 +554,9 @@ func (c *configSpec) sourcer(provider ConfigProvider) (DHCPServerSourcer, error)
 	case "file":
 		sourcer, err := NewFileSourcer(stable, rc, c.Version)
 		if err != nil {
-			glog.Fatalf("Can't load FileSourcer")
+			return nil, fmt.Errorf("Can't load FileSourcer: %s", err)
 		}
-		return sourcer, err
+		return sourcer, nil
 	}
 }
 
@@ -243,19 +564,21 @@ func (c *configSpec) algorithm(provider ConfigProvider) (DHCPBalancingAlgorithm,
 	// Balancing algorithms coming with the dhcplb source code
 	modulo := new(modulo)
 	rr := new(roundRobin)
+	consistent := &consistentHash{virtualNodes: c.VirtualNodes}
 	algorithms := map[string]DHCPBalancingAlgorithm{
-		modulo.Name(): modulo,
-		rr.Name():     rr,
+		modulo.Name():     modulo,
+		rr.Name():         rr,
+		consistent.Name(): consistent,
 	}
 	// load other non default algorithms from the ConfigProvider
 	providedAlgo, err := provider.NewDHCPBalancingAlgorithm(c.Version)
 	if err != nil {
-		glog.Fatalf("Provided load balancing implementation error: %s", err)
+		return nil, fmt.Errorf("Provided load balancing implementation error: %s", err)
 	}
 	if providedAlgo != nil {
 		if _, exists := algorithms[providedAlgo.Name()]; exists {
-			glog.Fatalf("Algorithm name %s exists already, pick another name.", providedAlgo.Name())
-
+			return nil, fmt.Errorf(
+				"Algorithm name %s exists already, pick another name", providedAlgo.Name())
 		}
 		algorithms[providedAlgo.Name()] = providedAlgo
 	}
@@ -265,25 +588,129 @@ func (c *configSpec) algorithm(provider ConfigProvider) (DHCPBalancingAlgorithm,
 		for k := range algorithms {
 			supported = append(supported, k)
 		}
-		glog.Fatalf(
+		sort.Strings(supported)
+		return nil, fmt.Errorf(
 			"'%s' is not a supported balancing algorithm. "+
 				"Supported balancing algorithms are: %v",
 			c.AlgorithmName, supported)
-		return nil, fmt.Errorf(
-			"'%s' is not a supported balancing algorithm", c.AlgorithmName)
 	}
 	lb.SetRCRatio(c.RCRatio)
 	return lb, nil
 }
 
-func newConfig(spec *configSpec, overrides map[string]Override, provider ConfigProvider) (*Config, error) {
+func (c *configSpec) healthCheck() (*HealthCheckConfig, error) {
+	if c.HealthCheck == nil {
+		return nil, nil
+	}
+	spec := c.HealthCheck
+	hc := &HealthCheckConfig{
+		Interval: time.Duration(spec.Interval) * time.Second,
+		Timeout:  time.Duration(spec.TimeoutMs) * time.Millisecond,
+		Rise:     spec.Rise,
+		Fall:     spec.Fall,
+		Probe:    spec.Probe,
+	}
+	if hc.Interval <= 0 {
+		hc.Interval = defaultHealthCheckInterval
+	}
+	if hc.Timeout <= 0 {
+		hc.Timeout = defaultHealthCheckTimeout
+	}
+	if hc.Rise <= 0 {
+		hc.Rise = defaultHealthCheckRise
+	}
+	if hc.Fall <= 0 {
+		hc.Fall = defaultHealthCheckFall
+	}
+	if hc.Probe == "" {
+		hc.Probe = ProbeDHCP
+	}
+	if hc.Probe != ProbeDHCP && hc.Probe != ProbeUDP {
+		return nil, fmt.Errorf(
+			"'%s' is not a supported health check probe, supported probes are: %s, %s",
+			hc.Probe, ProbeDHCP, ProbeUDP)
+	}
+	if spec.RelayAddr != "" {
+		hc.RelayAddr = net.ParseIP(spec.RelayAddr)
+		if hc.RelayAddr == nil {
+			return nil, fmt.Errorf("Unable to parse health check relay_addr %s", spec.RelayAddr)
+		}
+		// backends reply to the relay address, the probe would never see
+		// the replies and all the servers would be marked down
+		if hc.Probe == ProbeDHCP && !isLocalAddr(hc.RelayAddr) {
+			return nil, fmt.Errorf(
+				"Health check relay_addr %s must be a local address with the %s probe", spec.RelayAddr, ProbeDHCP)
+		}
+	}
+	return hc, nil
+}
+
+func (c *configSpec) replyTracking() (*ReplyTrackingConfig, error) {
+	if c.ReplyTracking == nil {
+		return nil, nil
+	}
+	if c.Version == 4 && c.Giaddr == "" {
+		// v4 replies only come back through dhcplb when it rewrites giaddr,
+		// otherwise they go straight from the servers to the relays
+		return nil, fmt.Errorf("reply_tracking requires giaddr in v4")
+	}
+	spec := c.ReplyTracking
+	if spec.MinReplyRatio < 0 || spec.MinReplyRatio > 1 {
+		return nil, fmt.Errorf("min_reply_ratio must be between 0 and 1, not %v", spec.MinReplyRatio)
+	}
+	rt := &ReplyTrackingConfig{
+		Window:        time.Duration(spec.Window) * time.Second,
+		HoldDown:      time.Duration(spec.HoldDown) * time.Second,
+		ReplyTimeout:  time.Duration(spec.ReplyTimeoutMs) * time.Millisecond,
+		MinRequests:   spec.MinRequests,
+		MinReplyRatio: spec.MinReplyRatio,
+	}
+	if rt.Window <= 0 {
+		rt.Window = defaultReplyTrackingWindow
+	}
+	if rt.HoldDown <= 0 {
+		rt.HoldDown = defaultReplyTrackingHoldDown
+	}
+	if rt.ReplyTimeout <= 0 {
+		rt.ReplyTimeout = defaultReplyTrackingTimeout
+	}
+	return rt, nil
+}
+
+func (c *configSpec) workerPool() (*WorkerPoolConfig, error) {
+	if c.Workers <= 0 {
+		// spawn a goroutine per packet
+		return nil, nil
+	}
+	wp := &WorkerPoolConfig{
+		Workers:    c.Workers,
+		QueueSize:  c.QueueSize,
+		DropPolicy: c.DropPolicy,
+	}
+	if wp.QueueSize <= 0 {
+		wp.QueueSize = c.Workers * defaultQueueSize
+	}
+	if wp.DropPolicy == "" {
+		wp.DropPolicy = DropNewest
+	}
+	if wp.DropPolicy != DropNewest && wp.DropPolicy != DropOldest {
+		return nil, fmt.Errorf(
+			"'%s' is not a supported drop policy, supported policies are: %s, %s",
+			wp.DropPolicy, DropNewest, DropOldest)
+	}
+	return wp, nil
+}
+
+func newConfig(spec *configSpec, overrides map[string]Override, provider ConfigProvider, validateSourcer bool) (*Config, error) {
 	if spec.Version != 4 && spec.Version != 6 {
 		return nil, fmt.Errorf("Supported version: 4, 6 - not %d", spec.Version)
 	}
 
+	// collect all the problems rather than stopping at the first one
+	var errs errorList
 	targetIP := net.ParseIP(spec.ListenAddr)
 	if targetIP == nil {
-		return nil, fmt.Errorf("Unable to parse IP %s", targetIP)
+		errs = errs.add(fmt.Errorf("Unable to parse listen_addr %s", spec.ListenAddr))
 	}
 	addr := &net.UDPAddr{
 		IP:   targetIP,
@@ -291,23 +718,67 @@ func newConfig(spec *configSpec, overrides map[string]Override, provider ConfigP
 		Zone: "",
 	}
 
-	algo, err := spec.algorithm(provider)
-	if err != nil {
-		return nil, err
+	if spec.RCRatio > 100 {
+		errs = errs.add(fmt.Errorf("rc_ratio must be between 0 and 100, not %d", spec.RCRatio))
 	}
-	sourcer, err := spec.sourcer(provider)
-	if err != nil {
-		return nil, err
-	}
-
+	algo, err := spec.algorithm(provider)
+	errs = errs.add(err)
 	// extras
+	var handler Handler
 	extras, err := provider.ParseExtras(spec.Extras)
 	if err != nil {
-		return nil, err
+		errs = errs.add(err)
+	} else {
+		handler, err = provider.NewHandler(extras, spec.Version)
+		errs = errs.add(err)
 	}
-	handler, err := provider.NewHandler(extras, spec.Version)
-	if err != nil {
-		return nil, err
+	healthCheck, err := spec.healthCheck()
+	errs = errs.add(err)
+	replyTracking, err := spec.replyTracking()
+	errs = errs.add(err)
+	workerPool, err := spec.workerPool()
+	errs = errs.add(err)
+	relayAgentInfo, err := spec.relayAgentInfo()
+	errs = errs.add(err)
+	zeroGiaddr, giaddr, relaySubnets, err := spec.giaddr()
+	errs = errs.add(err)
+	relayOptions, err := spec.relayOptions()
+	errs = errs.add(err)
+	if spec.BatchSize < 0 {
+		errs = errs.add(fmt.Errorf("batch_size must not be negative, got %d", spec.BatchSize))
+	}
+	if spec.MaxHops < 0 || spec.MaxHops > 255 {
+		errs = errs.add(fmt.Errorf("max_hops must be between 1 and 255, or 0 for the default, not %d", spec.MaxHops))
+	}
+	maxHops := spec.MaxHops
+	if maxHops == 0 {
+		maxHops = defaultMaxHops(spec.Version)
+	}
+	affinitySize := spec.AffinitySize
+	if affinitySize <= 0 {
+		affinitySize = defaultAffinitySize
+	}
+	relayTableSize := spec.RelayTableSize
+	if relayTableSize <= 0 {
+		relayTableSize = defaultRelayTableSize
+	}
+	activeOverrides, err := newOverrideSchedule(overrides, spec.Version, time.Now())
+	errs = errs.add(err)
+	shutdownTimeout := time.Duration(spec.ShutdownTimeout) * time.Second
+	if shutdownTimeout <= 0 {
+		shutdownTimeout = defaultShutdownTimeout
+	}
+	sourcer, err := spec.sourcer(provider)
+	errs = errs.add(err)
+	if validator, ok := sourcer.(DHCPServerSourcerValidator); ok && validateSourcer {
+		for _, err := range validator.Validate() {
+			errs = errs.add(err)
+		}
+	}
+	if len(errs) > 0 {
+		// the sourcer may be watching files, stop it as it won't be used
+		closeSourcer(sourcer)
+		return nil, errs
 	}
 
 	return &Config{
@@ -316,16 +787,33 @@ func newConfig(spec *configSpec, overrides map[string]Override, provider ConfigP
 		Algorithm: algo,
 		ServerUpdateInterval: time.Duration(
 			spec.UpdateServerInterval) * time.Second,
-		PacketBufSize: spec.PacketBufSize,
-		Handler:       handler,
-		HostSourcer:   sourcer,
-		RCRatio:       spec.RCRatio,
-		Overrides:     overrides,
-		Extras:        extras,
-		CacheSize:     spec.CacheSize,
-		CacheRate:     spec.CacheRate,
-		Rate:          spec.Rate,
-		ReplyAddr:     &net.UDPAddr{IP: net.ParseIP(spec.ReplyAddr)},
+		PacketBufSize:   spec.PacketBufSize,
+		Handler:         handler,
+		HostSourcer:     sourcer,
+		RCRatio:         spec.RCRatio,
+		Overrides:       overrides,
+		Extras:          extras,
+		CacheSize:       spec.CacheSize,
+		CacheRate:       spec.CacheRate,
+		Rate:            spec.Rate,
+		ReplyAddr:       &net.UDPAddr{IP: net.ParseIP(spec.ReplyAddr)},
+		HealthCheck:     healthCheck,
+		ReplyTracking:   replyTracking,
+		ShutdownTimeout: shutdownTimeout,
+		WorkerPool:      workerPool,
+		ListenSockets:   spec.ListenSockets,
+		BatchSize:       spec.BatchSize,
+		AdminWrites:     spec.AdminWrites,
+		AffinitySize:    affinitySize,
+		RelayTableSize:  relayTableSize,
+		RelayAgentInfo:  relayAgentInfo,
+		MaxHops:         maxHops,
+		ZeroGiaddr:      zeroGiaddr,
+		Giaddr:          giaddr,
+		RewriteGiaddr:   spec.Giaddr != "",
+		RelaySubnets:    relaySubnets,
+		RelayOptions:    relayOptions,
+		activeOverrides: activeOverrides,
 	}, nil
 }
 
@@ -336,10 +824,80 @@ func parseOverrides(file []byte, version int) (map[string]Override, error) {
 		glog.Errorf("Failed to parse JSON: %s", err)
 		return nil, err
 	}
+	var parsed map[string]Override
 	if version == 4 {
-		return overrides.V4, nil
+		parsed = overrides.V4
 	} else if version == 6 {
-		return overrides.V6, nil
+		parsed = overrides.V6
+	} else {
+		return nil, fmt.Errorf("Unsupported version %d, must be 4|6", version)
+	}
+	var errs errorList
+	for _, key := range sortedKeys(parsed) {
+		override := parsed[key]
+		if err := override.parse(); err != nil {
+			errs = errs.add(fmt.Errorf("Invalid override %s: %s", key, err))
+			delete(parsed, key)
+			continue
+		}
+		parsed[key] = override
+	}
+	if len(errs) > 0 {
+		// the valid overrides are returned too, so that all the problems
+		// can be reported
+		return parsed, errs
+	}
+	return parsed, nil
+}
+
+// parse validates an override read from the overrides file and parses its
+// timestamps.
+func (o *Override) parse() error {
+	if o.Host == "" && o.Tier == "" {
+		return fmt.Errorf("either host or tier is required")
+	}
+	if o.Host != "" && net.ParseIP(o.Host) == nil {
+		return fmt.Errorf("invalid host %s", o.Host)
+	}
+	if err := validateFallback(o.Fallback); err != nil {
+		return err
+	}
+	var err error
+	if o.Start != "" {
+		if o.startTime, err = parseOverrideTime(o.Start); err != nil {
+			return fmt.Errorf("invalid start: %s", err)
+		}
+	}
+	if o.Expiration != "" {
+		if o.expirationTime, err = parseOverrideTime(o.Expiration); err != nil {
+			return fmt.Errorf("invalid expiration: %s", err)
+		}
+	}
+	if !o.startTime.IsZero() && !o.expirationTime.IsZero() && !o.startTime.Before(o.expirationTime) {
+		return fmt.Errorf("start %s is not before expiration %s", o.Start, o.Expiration)
+	}
+	return nil
+}
+
+func validateFallback(fallback string) error {
+	switch {
+	case fallback == "", fallback == FallbackDrop, fallback == FallbackDefault:
+		return nil
+	case strings.HasPrefix(fallback, FallbackTierPrefix) && len(fallback) > len(FallbackTierPrefix):
+		return nil
+	}
+	return fmt.Errorf("'%s' is not a supported fallback, supported fallbacks are: %s, %s, %s<tier>",
+		fallback, FallbackDrop, FallbackDefault, FallbackTierPrefix)
+}
+
+// parseOverrideTime parses an RFC 3339 timestamp, or one in legacyTimeFormat.
+func parseOverrideTime(s string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, s)
+	if err == nil {
+		return t, nil
+	}
+	if t, legacyErr := time.Parse(legacyTimeFormat, s); legacyErr == nil {
+		return t, nil
 	}
-	return nil, fmt.Errorf("Unsupported version %d, must be 4|6", version)
+	return time.Time{}, err
 }
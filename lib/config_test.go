@@ -0,0 +1,372 @@
+/**
+ * Copyright (c) Facebook, Inc. and its affiliates.
+ *
+ * This source code is licensed under the MIT license found in the
+ * LICENSE file in the root directory of this source tree.
+ */
+
+package dhcplb
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testProvider is a ConfigProvider which only relies on what comes with
+// dhcplb.
+type testProvider struct{}
+
+func (testProvider) NewHostSourcer(sourcerType, args string, version int) (DHCPServerSourcer, error) {
+	return nil, nil
+}
+
+func (testProvider) ParseExtras(extras json.RawMessage) (interface{}, error) {
+	return nil, nil
+}
+
+func (testProvider) NewDHCPBalancingAlgorithm(version int) (DHCPBalancingAlgorithm, error) {
+	return nil, nil
+}
+
+func (testProvider) NewHandler(extras interface{}, version int) (Handler, error) {
+	return nil, nil
+}
+
+// writeTestConfig writes a v4 config using a file sourcer to dir, with the
+// given algorithm.
+func writeTestConfig(t *testing.T, dir, algorithm string) string {
+	hosts := filepath.Join(dir, "hosts.txt")
+	if err := os.WriteFile(hosts, []byte("10.0.0.1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config := `{"v4": {"version": 4, "listen_addr": "127.0.0.1", "port": 67,
+		"algorithm": "` + algorithm + `", "host_sourcer": "file:` + hosts + `"}}`
+	path := filepath.Join(dir, "config.json")
+	if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	for _, config := range []string{
+		`{"v4": {"version": 4, "listen_addr": "127.0.0.1", "algorithm": "xid", "host_sourcer": "file"}}`,
+		`{"v4": {"version": 4, "listen_addr": "127.0.0.1", "algorithm": "unknown", "host_sourcer": "file:hosts.txt"}}`,
+		`{"v4": {"version": 4, "listen_addr": "127.0.0.1", "algorithm": "xid", "host_sourcer": "file:/nonexistent"}}`,
+	} {
+		if _, err := ParseConfig([]byte(config), nil, 4, testProvider{}); err == nil {
+			t.Fatalf("Expected an error for %s", config)
+		}
+	}
+}
+
+func TestWatchConfigKeepsConfigOnError(t *testing.T) {
+	dir := t.TempDir()
+	path := writeTestConfig(t, dir, "xid")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	configs, err := WatchConfigContext(ctx, path, "", 4, testProvider{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an invalid config is not sent
+	writeTestConfig(t, dir, "unknown")
+	deadline := time.Now().Add(5 * time.Second)
+	for GetReloadStatus(4).ConsecutiveFailures == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("The invalid config wasn't reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if GetReloadStatus(4).LastError == "" {
+		t.Fatalf("The reload error wasn't recorded")
+	}
+
+	// and the next valid one is
+	writeTestConfig(t, dir, "rr")
+	for reloaded := false; !reloaded; {
+		select {
+		case config := <-configs:
+			config.HostSourcer.(*FileSourcer).Close()
+			if config.Algorithm.Name() != "rr" {
+				continue
+			}
+			if status := GetReloadStatus(4); status.ConsecutiveFailures != 0 || status.LastError != "" {
+				t.Fatalf("Unexpected reload status %+v", status)
+			}
+			reloaded = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("The valid config wasn't reloaded")
+		}
+	}
+
+	// going back to the config in use after a failure clears the error
+	writeTestConfig(t, dir, "unknown")
+	deadline = time.Now().Add(5 * time.Second)
+	for GetReloadStatus(4).ConsecutiveFailures == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("The invalid config wasn't reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	writeTestConfig(t, dir, "rr")
+	deadline = time.Now().Add(5 * time.Second)
+	for GetReloadStatus(4).LastError != "" {
+		if time.Now().After(deadline) {
+			t.Fatalf("The reload error wasn't cleared, status %+v", GetReloadStatus(4))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	dir := t.TempDir()
+	hosts := filepath.Join(dir, "hosts.txt")
+	if err := os.WriteFile(hosts, []byte("10.0.0.1\n10.0.0.2 weight=0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config := `{"v4": {"version": 4, "listen_addr": "not-an-ip", "algorithm": "unknown",
+		"rc_ratio": 101, "host_sourcer": "file:` + hosts + `"}}`
+	overrides := `{"v4": {"aa:bb:cc:dd:ee:ff": {"host": "10.0.0.1", "expiration": "tomorrow"}}}`
+	errs := ValidateConfig([]byte(config), []byte(overrides), 4, testProvider{})
+	// listen_addr, algorithm, rc_ratio, host list and expiration
+	if len(errs) != 5 {
+		t.Fatalf("Expected 5 problems, got %d: %v", len(errs), errs)
+	}
+
+	config = `{"v4": {"version": 4, "listen_addr": "127.0.0.1", "algorithm": "xid",
+		"host_sourcer": "file:` + hosts + `"}}`
+	if err := os.WriteFile(hosts, []byte("10.0.0.1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if errs := ValidateConfig([]byte(config), nil, 4, testProvider{}); len(errs) != 0 {
+		t.Fatalf("Unexpected problems %v", errs)
+	}
+	// unknown keys are ignored when loading, but reported
+	overrides = `{"v4": {"aa:bb:cc:dd:ee:zz": {"host": "10.0.0.1"}}}`
+	loaded, err := ParseConfig([]byte(config), []byte(overrides), 4, testProvider{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	closeSourcer(loaded.HostSourcer)
+	if errs := ValidateConfig([]byte(config), []byte(overrides), 4, testProvider{}); len(errs) != 1 {
+		t.Fatalf("Expected 1 problem, got %v", errs)
+	}
+}
+
+func TestWatchConfigsReloadsChangedSections(t *testing.T) {
+	dir := t.TempDir()
+	hosts := filepath.Join(dir, "hosts.txt")
+	if err := os.WriteFile(hosts, []byte("10.0.0.1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "config.json")
+	write := func(v6Algorithm string) {
+		config := `{
+			"v4": {"version": 4, "listen_addr": "127.0.0.1", "algorithm": "xid", "host_sourcer": "file:` + hosts + `"},
+			"v6": {"version": 6, "listen_addr": "::1", "algorithm": "` + v6Algorithm + `", "host_sourcer": "file:` + hosts + `"}
+		}`
+		if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("xid")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	configChans, err := WatchConfigs(ctx, path, "", []int{4, 6}, testProvider{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	receive := func(version int, algorithm string) {
+		for {
+			select {
+			case config := <-configChans[version]:
+				config.HostSourcer.(*FileSourcer).Close()
+				if config.Algorithm.Name() == algorithm {
+					return
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("The v%d config wasn't reloaded", version)
+			}
+		}
+	}
+
+	// the first change reloads both versions
+	write("rr")
+	receive(4, "xid")
+	receive(6, "rr")
+
+	// then only the version whose section changed is reloaded
+	write("consistent")
+	receive(6, "consistent")
+	select {
+	case <-configChans[4]:
+		t.Fatalf("The v4 config was reloaded while its section didn't change")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestLoadConfigFormats(t *testing.T) {
+	dir := t.TempDir()
+	hosts := filepath.Join(dir, "hosts.txt")
+	if err := os.WriteFile(hosts, []byte("10.0.0.1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"config.json": `{"v4": {"version": 4, "listen_addr": "127.0.0.1", "port": 67,
+			"algorithm": "xid", "rc_ratio": 10, "host_sourcer": "file:` + hosts + `"}}`,
+		"config.yaml": `
+v4:
+  version: 4
+  listen_addr: 127.0.0.1
+  port: 67
+  algorithm: xid
+  rc_ratio: 10
+  host_sourcer: file:` + hosts + `
+`,
+		"config.toml": `
+[v4]
+version = 4
+listen_addr = "127.0.0.1"
+port = 67
+algorithm = "xid"
+rc_ratio = 10
+host_sourcer = "file:` + hosts + `"
+`,
+		"overrides.json": `{"v4": {"aa:bb:cc:dd:ee:ff": {"host": "10.0.0.2", "expiration": "2030-01-01T00:00:00Z"}}}`,
+		"overrides.yml": `
+v4:
+  "aa:bb:cc:dd:ee:ff":
+    host: 10.0.0.2
+    expiration: 2030-01-01T00:00:00Z
+`,
+		"overrides.toml": `
+[v4."aa:bb:cc:dd:ee:ff"]
+host = "10.0.0.2"
+expiration = 2030-01-01T00:00:00Z
+`,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tt := range [][2]string{
+		{"config.json", "overrides.json"},
+		{"config.yaml", "overrides.yml"},
+		{"config.toml", "overrides.toml"},
+	} {
+		config, err := LoadConfig(filepath.Join(dir, tt[0]), filepath.Join(dir, tt[1]), 4, testProvider{})
+		if err != nil {
+			t.Fatalf("%s: %s", tt[0], err)
+		}
+		closeSourcer(config.HostSourcer)
+		if config.Addr.String() != "127.0.0.1:67" || config.RCRatio != 10 {
+			t.Fatalf("%s: unexpected addr %s or rc_ratio %d", tt[0], config.Addr, config.RCRatio)
+		}
+		override := config.Overrides["aa:bb:cc:dd:ee:ff"]
+		if override.Host != "10.0.0.2" || !override.expirationTime.Equal(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)) {
+			t.Fatalf("%s: unexpected override %+v", tt[1], override)
+		}
+	}
+
+	// the same validation applies to every format
+	bad := filepath.Join(dir, "bad.yaml")
+	if err := os.WriteFile(bad, []byte("v4:\n  version: 4\n  listen_addr: not-an-ip\n  algorithm: xid\n  host_sourcer: file:"+hosts+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if errs := ValidateConfigFiles(bad, "", 4, testProvider{}); len(errs) != 1 {
+		t.Fatalf("Expected 1 problem, got %v", errs)
+	}
+}
+
+func TestConfigLayers(t *testing.T) {
+	env, err := NewEnvConfigLayer([]string{
+		"HOME=/root",
+		"DHCPLB_V4_RC_RATIO=10",
+		"DHCPLB_V4_ALGORITHM=rr",
+		"DHCPLB_V6_RC_RATIO=50",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	flags := NewConfigLayer("flag")
+	if err := flags.Set(4, "rc_ratio", "20"); err != nil {
+		t.Fatal(err)
+	}
+	SetConfigLayers(env, flags)
+	defer SetConfigLayers()
+
+	path := writeTestConfig(t, t.TempDir(), "xid")
+	config, err := LoadConfig(path, "", 4, testProvider{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	closeSourcer(config.HostSourcer)
+	if config.RCRatio != 20 || config.Algorithm.Name() != "rr" {
+		t.Fatalf("Expected rc_ratio 20 and algorithm rr, got %d and %s", config.RCRatio, config.Algorithm.Name())
+	}
+	view := newConfigView(config)
+	if view.Sources["rc_ratio"] != "flag" || view.Sources["algorithm"] != "env" || len(view.Sources) != 2 {
+		t.Fatalf("Unexpected sources %v", view.Sources)
+	}
+
+	// layered values are validated like the config file
+	flags.Set(4, "rc_ratio", "101")
+	if _, err := LoadConfig(path, "", 4, testProvider{}); err == nil {
+		t.Fatalf("Expected an error for rc_ratio 101")
+	}
+
+	for _, tt := range [][2]string{
+		{"unknown_field", "1"},
+		{"rc_ratio", "ten"},
+		{"port", "-"},
+		{"version", "6"},
+		{"extras", "{}"},
+	} {
+		if err := flags.Set(4, tt[0], tt[1]); err == nil {
+			t.Fatalf("Expected an error for %s=%s", tt[0], tt[1])
+		}
+	}
+	if _, err := NewEnvConfigLayer([]string{"DHCPLB_V4_RC_RATIO=ten"}); err == nil {
+		t.Fatalf("Expected an error for an invalid environment variable")
+	}
+}
+
+func TestConfigLayersMergeSections(t *testing.T) {
+	spec := configSpec{HealthCheck: &healthCheckSpec{Interval: 10, Rise: 3, Probe: ProbeUDP}}
+	original, file := spec.HealthCheck, *spec.HealthCheck
+	if err := setSpecField(&spec, "health_check", `{"interval": 5}`); err != nil {
+		t.Fatal(err)
+	}
+	if err := setSpecField(&spec, "health_check", `{"fall": 4}`); err != nil {
+		t.Fatal(err)
+	}
+	expected := healthCheckSpec{Interval: 5, Rise: 3, Fall: 4, Probe: ProbeUDP}
+	if *spec.HealthCheck != expected {
+		t.Fatalf("Expected %+v, got %+v", expected, *spec.HealthCheck)
+	}
+	if *original != file {
+		t.Fatalf("The section of the config file was modified in place")
+	}
+	// invalid values leave the section unchanged
+	if err := setSpecField(&spec, "health_check", `{"rise": "three"}`); err == nil {
+		t.Fatalf("Expected an error for an invalid rise")
+	}
+	if *spec.HealthCheck != expected {
+		t.Fatalf("Section changed by an invalid value: %+v", *spec.HealthCheck)
+	}
+	// sections missing from the file are created
+	if err := setSpecField(&spec, "reply_tracking", `{"window": 30}`); err != nil {
+		t.Fatal(err)
+	}
+	if spec.ReplyTracking == nil || spec.ReplyTracking.Window != 30 {
+		t.Fatalf("Unexpected reply_tracking %+v", spec.ReplyTracking)
+	}
+}
@@ -0,0 +1,203 @@
+/**
+ * Copyright (c) Facebook, Inc. and its affiliates.
+ *
+ * This source code is licensed under the MIT license found in the
+ * LICENSE file in the root directory of this source tree.
+ */
+
+package dhcplb
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/golang/glog"
+	lru "github.com/hashicorp/golang-lru/v2"
+)
+
+// defaultVirtualNodes is the number of points each server gets on the ring
+// when not specified in the config.
+const defaultVirtualNodes = 100
+
+// listRingCacheSize is the number of rings built for the server lists passed
+// to SelectServerFromList which are kept around.
+const listRingCacheSize = 64
+
+// consistentHash implements consistent hashing on a ring of virtual nodes.
+// Unlike modulo, adding or removing a server only remaps the clients that
+// were (or will be) served by that server.
+type consistentHash struct {
+	lock         sync.RWMutex
+	stable       *hashRing
+	rc           *hashRing
+	rcRatio      uint32
+	virtualNodes int
+	// rings built for tier overrides, keyed by the servers of the list
+	listLock  sync.Mutex
+	listRings *lru.Cache[string, *listRing]
+}
+
+// hashRing holds the points of the servers on the ring, sorted by hash.
+type hashRing struct {
+	points  []uint32
+	servers []*DHCPServer
+}
+
+func newHashRing(list []*DHCPServer, virtualNodes int) *hashRing {
+	if virtualNodes <= 0 {
+		virtualNodes = defaultVirtualNodes
+	}
+	type point struct {
+		hash   uint32
+		server *DHCPServer
+	}
+	points := make([]point, 0, totalWeight(list)*virtualNodes)
+	for _, server := range list {
+		// heavier servers get proportionally more points on the ring
+		for i := 0; i < virtualNodes*server.weight(); i++ {
+			hasher := fnv.New32a()
+			fmt.Fprintf(hasher, "%s:%d-%d", server.Address, server.Port, i)
+			points = append(points, point{mix32(hasher.Sum32()), server})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool {
+		return points[i].hash < points[j].hash
+	})
+	ring := &hashRing{
+		points:  make([]uint32, len(points)),
+		servers: make([]*DHCPServer, len(points)),
+	}
+	for i, p := range points {
+		ring.points[i] = p.hash
+		ring.servers[i] = p.server
+	}
+	return ring
+}
+
+// mix32 is the murmur3 finalizer. FNV-1a doesn't spread similar inputs (like
+// the labels of the virtual nodes of a server) well enough across the ring.
+func mix32(h uint32) uint32 {
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+	return h
+}
+
+// get returns the first server found going clockwise from hash.
+func (r *hashRing) get(hash uint32) (*DHCPServer, error) {
+	if r == nil || len(r.points) == 0 {
+		return nil, errors.New("Server list is empty")
+	}
+	hash = mix32(hash)
+	i := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i] >= hash
+	})
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.servers[i], nil
+}
+
+func (c *consistentHash) Name() string {
+	return "consistent"
+}
+
+func (c *consistentHash) getHash(token []byte) uint32 {
+	hasher := fnv.New32a()
+	hasher.Write(token)
+	hash := hasher.Sum32()
+	return hash
+}
+
+func (c *consistentHash) SetRCRatio(ratio uint32) {
+	atomic.StoreUint32(&c.rcRatio, ratio)
+}
+
+func (c *consistentHash) SelectServerFromList(list []*DHCPServer, message *DHCPMessage) (*DHCPServer, error) {
+	ring := c.listRing(list)
+	server, err := ring.get(c.getHash(message.ClientID))
+	if err != nil {
+		return nil, err
+	}
+	// the cached ring may have been built from another copy of the list
+	return list[ring.index[server]], nil
+}
+
+// listRing is the ring of a list passed to SelectServerFromList, with the
+// position of each server in the list.
+type listRing struct {
+	*hashRing
+	index map[*DHCPServer]int
+}
+
+// listRing returns the ring of a list passed to SelectServerFromList. Lists
+// come from tier overrides and are built again for every packet, so rings
+// are cached by the address, port and weight of their servers.
+func (c *consistentHash) listRing(list []*DHCPServer) *listRing {
+	var key strings.Builder
+	for _, server := range list {
+		fmt.Fprintf(&key, "%s:%d/%d,", server.Address, server.Port, server.weight())
+	}
+
+	c.listLock.Lock()
+	defer c.listLock.Unlock()
+	if c.listRings == nil {
+		// can only fail for a non-positive size
+		c.listRings, _ = lru.New[string, *listRing](listRingCacheSize)
+	}
+	ring, ok := c.listRings.Get(key.String())
+	if !ok {
+		ring = &listRing{
+			hashRing: newHashRing(list, c.virtualNodes),
+			index:    make(map[*DHCPServer]int, len(list)),
+		}
+		for i, server := range list {
+			ring.index[server] = i
+		}
+		c.listRings.Add(key.String(), ring)
+	}
+	return ring
+}
+
+func (c *consistentHash) SelectRatioBasedDhcpServer(message *DHCPMessage) (*DHCPServer, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	hash := c.getHash(message.ClientID)
+
+	// convert to a number 0-100 and then see if it should be RC
+	if hash%100 < atomic.LoadUint32(&c.rcRatio) {
+		return c.rc.get(hash)
+	}
+	// otherwise go to stable
+	return c.stable.get(hash)
+}
+
+func (c *consistentHash) UpdateServerList(name string, list []*DHCPServer, ptr **hashRing) error {
+	ring := newHashRing(list, c.virtualNodes)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	*ptr = ring
+	glog.Infof("List of available %s servers:", name)
+	for _, server := range list {
+		glog.Infof("%s", server)
+	}
+	return nil
+}
+
+func (c *consistentHash) UpdateStableServerList(list []*DHCPServer) error {
+	return c.UpdateServerList("stable", list, &c.stable)
+}
+
+func (c *consistentHash) UpdateRCServerList(list []*DHCPServer) error {
+	return c.UpdateServerList("rc", list, &c.rc)
+}
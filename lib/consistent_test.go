@@ -0,0 +1,212 @@
+/**
+ * Copyright (c) Facebook, Inc. and its affiliates.
+ *
+ * This source code is licensed under the MIT license found in the
+ * LICENSE file in the root directory of this source tree.
+ */
+
+package dhcplb
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+func makeConsistentServers(n int) []*DHCPServer {
+	servers := make([]*DHCPServer, n)
+	for i := 0; i < n; i++ {
+		servers[i] = &DHCPServer{
+			Address: net.IPv4(10, 0, 0, byte(i)),
+			Port:    i, //use port to tell which one we picked
+		}
+	}
+	return servers
+}
+
+func makeClientID(i int) []byte {
+	id := make([]byte, 8)
+	binary.BigEndian.PutUint64(id, uint64(i)*0x9e3779b97f4a7c15)
+	return id
+}
+
+func TestConsistentEmpty(t *testing.T) {
+	subject := new(consistentHash)
+	_, err := subject.SelectRatioBasedDhcpServer(&DHCPMessage{
+		ClientID: []byte{0},
+	})
+	if err == nil {
+		t.Fatalf("Should throw an error if server list is empty")
+	}
+	_, err = subject.SelectServerFromList(nil, &DHCPMessage{
+		ClientID: []byte{0},
+	})
+	if err == nil {
+		t.Fatalf("Should throw an error if server list is empty")
+	}
+}
+
+func TestConsistentStable(t *testing.T) {
+	subject := new(consistentHash)
+	servers := makeConsistentServers(4)
+	subject.UpdateStableServerList(servers)
+	msg := DHCPMessage{
+		ClientID: []byte{0x54, 0xc9, 0xeb, 0x57, 0xa, 0x57},
+	}
+	first, err := subject.SelectRatioBasedDhcpServer(&msg)
+	if err != nil {
+		t.Fatalf("Unexpected error selecting server: %s", err)
+	}
+	for i := 0; i < 10; i++ {
+		server, _ := subject.SelectRatioBasedDhcpServer(&msg)
+		if server != first {
+			t.Fatalf("Chose a different server for the same client: %d, %d",
+				server.Port, first.Port)
+		}
+	}
+	fromList, err := subject.SelectServerFromList(servers, &msg)
+	if err != nil {
+		t.Fatalf("Unexpected error selecting server: %s", err)
+	}
+	if fromList != first {
+		t.Fatalf("SelectServerFromList should agree with the stable ring: %d, %d",
+			fromList.Port, first.Port)
+	}
+}
+
+func TestConsistentListCache(t *testing.T) {
+	subject := new(consistentHash)
+	msg := DHCPMessage{ClientID: makeClientID(1)}
+	first, err := subject.SelectServerFromList(makeConsistentServers(4), &msg)
+	if err != nil {
+		t.Fatalf("Unexpected error selecting server: %s", err)
+	}
+	// tier overrides build a new list for every packet
+	servers := makeConsistentServers(4)
+	server, err := subject.SelectServerFromList(servers, &msg)
+	if err != nil {
+		t.Fatalf("Unexpected error selecting server: %s", err)
+	}
+	if server != servers[first.Port] {
+		t.Fatalf("Expected the server from the list passed, got %v", server)
+	}
+	if subject.listRings.Len() != 1 {
+		t.Fatalf("Expected the ring to be reused, got %d rings", subject.listRings.Len())
+	}
+	subject.SelectServerFromList(servers[:3], &msg)
+	if subject.listRings.Len() != 2 {
+		t.Fatalf("Expected a new ring for a different list, got %d rings", subject.listRings.Len())
+	}
+}
+
+func TestConsistentBalance(t *testing.T) {
+	const clients = 10000
+	subject := new(consistentHash)
+	servers := makeConsistentServers(4)
+	subject.UpdateStableServerList(servers)
+	counts := make(map[int]int)
+	for i := 0; i < clients; i++ {
+		server, err := subject.SelectRatioBasedDhcpServer(&DHCPMessage{
+			ClientID: makeClientID(i),
+		})
+		if err != nil {
+			t.Fatalf("Unexpected error selecting server: %s", err)
+		}
+		counts[server.Port]++
+	}
+	for _, server := range servers {
+		// allow +/- 50% of the fair share
+		share := clients / len(servers)
+		if counts[server.Port] < share/2 || counts[server.Port] > share*3/2 {
+			t.Fatalf("Unbalanced distribution: %v", counts)
+		}
+	}
+}
+
+func TestConsistentRemap(t *testing.T) {
+	const clients = 10000
+	subject := new(consistentHash)
+	servers := makeConsistentServers(10)
+	subject.UpdateStableServerList(servers)
+	before := make([]*DHCPServer, clients)
+	for i := 0; i < clients; i++ {
+		before[i], _ = subject.SelectRatioBasedDhcpServer(&DHCPMessage{
+			ClientID: makeClientID(i),
+		})
+	}
+
+	// remove a server, only the clients it was serving should move
+	removed := servers[3]
+	subject.UpdateStableServerList(append(append([]*DHCPServer{}, servers[:3]...), servers[4:]...))
+	moved := 0
+	for i := 0; i < clients; i++ {
+		server, _ := subject.SelectRatioBasedDhcpServer(&DHCPMessage{
+			ClientID: makeClientID(i),
+		})
+		if server == removed {
+			t.Fatalf("Chose a server which was removed")
+		}
+		if server != before[i] {
+			if before[i] != removed {
+				t.Fatalf("Client %d moved from %d to %d", i, before[i].Port, server.Port)
+			}
+			moved++
+		}
+	}
+	if moved > clients*2/len(servers) {
+		t.Fatalf("Too many clients remapped: %d/%d", moved, clients)
+	}
+}
+
+func TestConsistentVirtualNodes(t *testing.T) {
+	const clients = 1000
+	servers := makeConsistentServers(4)
+	assign := func(subject *consistentHash) []int {
+		ports := make([]int, clients)
+		for i := range ports {
+			server, err := subject.SelectRatioBasedDhcpServer(&DHCPMessage{ClientID: makeClientID(i)})
+			if err != nil {
+				t.Fatalf("Unexpected error selecting server: %s", err)
+			}
+			ports[i] = server.Port
+		}
+		return ports
+	}
+	defaults := &consistentHash{}
+	defaults.UpdateStableServerList(servers)
+	defaultPorts := assign(defaults)
+
+	for _, tt := range []struct {
+		virtualNodes int
+		// points of each server on the ring
+		points int
+	}{
+		// 0 and negative values fall back to the default
+		{-1, defaultVirtualNodes},
+		{0, defaultVirtualNodes},
+		{1, 1},
+		{10, 10},
+		{defaultVirtualNodes, defaultVirtualNodes},
+		{500, 500},
+	} {
+		spec := &configSpec{AlgorithmName: "consistent", VirtualNodes: tt.virtualNodes}
+		algorithm, err := spec.algorithm(testProvider{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		subject := algorithm.(*consistentHash)
+		subject.UpdateStableServerList(servers)
+		if points := len(subject.stable.points); points != tt.points*len(servers) {
+			t.Fatalf("virtual_nodes %d: expected %d points, got %d", tt.virtualNodes, tt.points*len(servers), points)
+		}
+		moved := 0
+		for i, port := range assign(subject) {
+			if port != defaultPorts[i] {
+				moved++
+			}
+		}
+		if changed := moved > 0; changed != (tt.points != defaultVirtualNodes) {
+			t.Fatalf("virtual_nodes %d: %d/%d clients mapped differently than with the default", tt.virtualNodes, moved, clients)
+		}
+	}
+}
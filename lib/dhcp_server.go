@@ -18,6 +18,12 @@ type DHCPServer struct {
 	Address  net.IP
 	Port     int
 	IsRC     bool
+	// Weight is the capacity of the server relative to the others in the
+	// same list, values lower than 1 are treated as 1.
+	Weight int
+	// Draining servers only get the clients they served before, new clients
+	// are sent to the other servers of the same list.
+	Draining bool
 }
 
 // NewDHCPServer returns an instance of DHCPServer
@@ -38,9 +44,45 @@ func (d *DHCPServer) udpAddr() *net.UDPAddr {
 	}
 }
 
+func (d *DHCPServer) weight() int {
+	if d.Weight < 1 {
+		return 1
+	}
+	return d.Weight
+}
+
 func (d *DHCPServer) String() string {
+	s := fmt.Sprintf("Hostname: %s, IP: %s, Port: %d", d.Hostname, d.Address, d.Port)
+	if d.weight() > 1 {
+		s += fmt.Sprintf(", Weight: %d", d.Weight)
+	}
 	if d.IsRC {
-		return fmt.Sprintf("Hostname: %s, IP: %s, Port: %d (RC)", d.Hostname, d.Address, d.Port)
+		s += " (RC)"
+	}
+	if d.Draining {
+		s += " (draining)"
+	}
+	return s
+}
+
+// totalWeight returns the sum of the weights of the servers in list.
+func totalWeight(list []*DHCPServer) int {
+	total := 0
+	for _, server := range list {
+		total += server.weight()
+	}
+	return total
+}
+
+// selectWeighted maps n, which must be lower than totalWeight(list), to a
+// server so that each server gets a share of the [0, totalWeight) range
+// proportional to its weight.
+func selectWeighted(list []*DHCPServer, n int) *DHCPServer {
+	for _, server := range list {
+		n -= server.weight()
+		if n < 0 {
+			return server
+		}
 	}
-	return fmt.Sprintf("Hostname: %s, IP: %s, Port: %d", d.Hostname, d.Address, d.Port)
+	return list[len(list)-1]
 }
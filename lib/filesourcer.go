@@ -9,10 +9,12 @@ package dhcplb
 
 import (
 	"bufio"
+	"fmt"
 	"net"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/fsnotify/fsnotify"
@@ -39,42 +41,49 @@ type FileSourcer struct {
 func NewFileSourcer(stablePath, rcPath string, version int) (*FileSourcer, error) {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
-		glog.Fatal(err)
+		return nil, err
 	}
 	err = watcher.Add(filepath.Dir(stablePath))
 	if err != nil {
-		glog.Fatalf("Error watching stable: %s", err)
+		watcher.Close()
+		return nil, fmt.Errorf("Error watching stable: %s", err)
 	}
 	// RC is optional, only add to fsnotify and read if rcPath is present
 	if len(rcPath) > 0 {
 		err = watcher.Add(filepath.Dir(rcPath))
 		if err != nil {
-			glog.Fatalf("Error watching rc: %s", err)
+			watcher.Close()
+			return nil, fmt.Errorf("Error watching rc: %s", err)
 		}
 	}
-	sourcer, err := &FileSourcer{
+	sourcer := &FileSourcer{
 		stablePath: stablePath,
 		rcPath:     rcPath,
 		version:    version,
 		watcher:    watcher,
-	}, nil
-	sourcer.lock.Lock()
+	}
 	sourcer.stableServers, err = sourcer.GetServersFromTier(stablePath)
 	if err != nil {
-		glog.Errorf("Failed to load stable servers: %s", err)
+		watcher.Close()
+		return nil, fmt.Errorf("Failed to load stable servers: %s", err)
 	}
 	if len(rcPath) > 0 {
 		sourcer.rcServers, err = sourcer.GetServersFromTier(rcPath)
 		if err != nil {
-			glog.Errorf("Failed to load RC servers: %s", err)
+			watcher.Close()
+			return nil, fmt.Errorf("Failed to load RC servers: %s", err)
 		}
 	}
-	sourcer.lock.Unlock()
 	go sourcer.watchFsnotifyEvents()
-	return sourcer, err
+	return sourcer, nil
 }
 
-// GetServersFromTier returns a list of DHCPServer from a file
+// GetServersFromTier returns a list of DHCPServer from a file. Each line of
+// the file is a host[:port] optionally followed by space separated attributes:
+// weight=N and drain, to stop sending new clients to the server, eg:
+//
+//	10.0.0.1:67 weight=3
+//	10.0.0.2:67 drain
 func (fs *FileSourcer) GetServersFromTier(path string) ([]*DHCPServer, error) {
 	inputFile, err := os.Open(path)
 	if err != nil {
@@ -85,59 +94,121 @@ func (fs *FileSourcer) GetServersFromTier(path string) ([]*DHCPServer, error) {
 
 	var servers []*DHCPServer
 	for scanner.Scan() {
-		var (
-			hostname string
-			port     int64
-		)
-		line := scanner.Text()
-		h, p, err := net.SplitHostPort(line)
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		server, err := fs.parseServerLine(scanner.Text())
 		if err != nil {
-			hostname = line
-			if fs.version == 4 {
-				port = 67
-			} else {
-				port = 547
-			}
-		} else {
-			hostname = h
-			var errPort error
-			port, errPort = strconv.ParseInt(p, 10, 32)
-			if errPort != nil {
-				glog.Errorf("Can't convert port %s to int", p)
-				continue
-			}
+			glog.Errorf("%s", err)
+			continue
 		}
-		ip := net.ParseIP(hostname)
-		if ip == nil {
-			ips, err := net.LookupHost(hostname)
-			if err != nil {
-				glog.Errorf("Can't resolve IPv4 for %s", hostname)
+		servers = append(servers, server)
+	}
+	return servers, nil
+}
+
+// Validate returns the problems found in the host lists, with the line they
+// are on. Malformed lines are otherwise logged and skipped.
+func (fs *FileSourcer) Validate() []error {
+	var errs []error
+	for _, path := range []string{fs.stablePath, fs.rcPath} {
+		if path == "" {
+			continue
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		scanner := bufio.NewScanner(file)
+		for line := 1; scanner.Scan(); line++ {
+			if strings.TrimSpace(scanner.Text()) == "" {
 				continue
 			}
-			for i := range ips {
-				addr := net.ParseIP(ips[i])
-				if addr != nil {
-					if fs.version == 4 && addr.To4() != nil {
-						ip = addr
-						break
-					}
-					if fs.version == 6 && addr.To16() != nil {
-						ip = addr
-						break
-					}
+			if _, err := fs.parseServerLine(scanner.Text()); err != nil {
+				errs = append(errs, fmt.Errorf("%s:%d: %s", path, line, err))
+			}
+		}
+		file.Close()
+	}
+	return errs
+}
+
+func (fs *FileSourcer) parseServerLine(line string) (*DHCPServer, error) {
+	var (
+		hostname string
+		port     int64
+		weight   int64
+		draining bool
+	)
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("Empty line in host list")
+	}
+	h, p, err := net.SplitHostPort(fields[0])
+	if err != nil {
+		hostname = fields[0]
+		if fs.version == 4 {
+			port = 67
+		} else {
+			port = 547
+		}
+	} else {
+		hostname = h
+		var errPort error
+		port, errPort = strconv.ParseInt(p, 10, 32)
+		if errPort != nil {
+			return nil, fmt.Errorf("Can't convert port %s to int", p)
+		}
+	}
+	for _, attr := range fields[1:] {
+		if attr == "drain" {
+			draining = true
+			continue
+		}
+		kv := strings.SplitN(attr, "=", 2)
+		if len(kv) != 2 || kv[0] != "weight" {
+			return nil, fmt.Errorf("Unknown attribute %s for %s", attr, hostname)
+		}
+		weight, err = strconv.ParseInt(kv[1], 10, 32)
+		if err != nil || weight < 1 {
+			return nil, fmt.Errorf("Invalid weight %s for %s", kv[1], hostname)
+		}
+	}
+	ip := net.ParseIP(hostname)
+	if ip == nil {
+		ips, err := net.LookupHost(hostname)
+		if err != nil {
+			return nil, fmt.Errorf("Can't resolve IPv4 for %s", hostname)
+		}
+		for i := range ips {
+			addr := net.ParseIP(ips[i])
+			if addr != nil {
+				if fs.version == 4 && addr.To4() != nil {
+					ip = addr
+					break
+				}
+				if fs.version == 6 && addr.To16() != nil {
+					ip = addr
+					break
 				}
 			}
 		}
-		server := NewDHCPServer(hostname, ip, int(port))
-		servers = append(servers, server)
 	}
-	return servers, nil
+	server := NewDHCPServer(hostname, ip, int(port))
+	server.Weight = int(weight)
+	server.Draining = draining
+	return server, nil
 }
 
 func (fs *FileSourcer) watchFsnotifyEvents() {
 	for {
 		select {
-		case ev := <-fs.watcher.Events:
+		case ev, ok := <-fs.watcher.Events:
+			if !ok {
+				// watcher was closed
+				return
+			}
 			if ev.Op&fsnotify.Write != 0 {
 				glog.Infof("Event: %s File changed, reloading host list", ev)
 				fs.lock.Lock()
@@ -154,12 +225,20 @@ func (fs *FileSourcer) watchFsnotifyEvents() {
 				}
 				fs.lock.Unlock()
 			}
-		case err := <-fs.watcher.Errors:
+		case err, ok := <-fs.watcher.Errors:
+			if !ok {
+				return
+			}
 			glog.Error("Error: ", err)
 		}
 	}
 }
 
+// Close stops watching the host list files for changes.
+func (fs *FileSourcer) Close() error {
+	return fs.watcher.Close()
+}
+
 // GetStableServers returns a list of stable dhcp servers
 func (fs *FileSourcer) GetStableServers() ([]*DHCPServer, error) {
 	return fs.stableServers, nil
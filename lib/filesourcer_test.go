@@ -0,0 +1,54 @@
+/**
+ * Copyright (c) Facebook, Inc. and its affiliates.
+ *
+ * This source code is licensed under the MIT license found in the
+ * LICENSE file in the root directory of this source tree.
+ */
+
+package dhcplb
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGetServersFromTier(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts.txt")
+	hosts := "10.0.0.1\n" +
+		"10.0.0.2:6767 weight=3\n" +
+		"\n" +
+		"10.0.0.3 weight=0\n" +
+		"10.0.0.4 color=red\n" +
+		"10.0.0.5 weight=2\n" +
+		"10.0.0.6 drain weight=2\n"
+	if err := os.WriteFile(path, []byte(hosts), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fs := &FileSourcer{version: 4}
+	servers, err := fs.GetServersFromTier(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := []struct {
+		ip       string
+		port     int
+		weight   int
+		draining bool
+	}{
+		{"10.0.0.1", 67, 0, false},
+		{"10.0.0.2", 6767, 3, false},
+		{"10.0.0.5", 67, 2, false},
+		{"10.0.0.6", 67, 2, true},
+	}
+	if len(servers) != len(expected) {
+		t.Fatalf("Expected %d servers, got %v", len(expected), servers)
+	}
+	for i, e := range expected {
+		if !servers[i].Address.Equal(net.ParseIP(e.ip)) || servers[i].Port != e.port ||
+			servers[i].Weight != e.weight || servers[i].Draining != e.draining {
+			t.Errorf("Expected %s:%d weight=%d draining=%t, got %s", e.ip, e.port, e.weight, e.draining, servers[i])
+		}
+	}
+}
@@ -0,0 +1,73 @@
+/**
+ * Copyright (c) Facebook, Inc. and its affiliates.
+ *
+ * This source code is licensed under the MIT license found in the
+ * LICENSE file in the root directory of this source tree.
+ */
+
+package dhcplb
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// toJSON converts a config or overrides file to JSON according to the
+// extension of its path: .yaml/.yml files are parsed as YAML, .toml files as
+// TOML, and anything else is expected to be JSON already. Converting instead
+// of decoding into the config structures directly means that all the formats
+// use the same field names and go through the same validation.
+func toJSON(path string, data []byte) ([]byte, error) {
+	var decoded interface{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(data, &decoded); err != nil {
+			return nil, fmt.Errorf("Failed to parse YAML file %s: %s", path, err)
+		}
+		decoded = jsonCompatible(decoded)
+	case ".toml":
+		var table map[string]interface{}
+		if _, err := toml.Decode(string(data), &table); err != nil {
+			return nil, fmt.Errorf("Failed to parse TOML file %s: %s", path, err)
+		}
+		decoded = table
+	default:
+		return data, nil
+	}
+	if decoded == nil {
+		// empty file
+		return []byte{}, nil
+	}
+	converted, err := json.Marshal(decoded)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to convert %s to JSON: %s", path, err)
+	}
+	return converted, nil
+}
+
+// jsonCompatible replaces the maps with non-string keys that YAML produces
+// (e.g. for `1: foo`) with maps keyed by strings, which json can encode.
+func jsonCompatible(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = jsonCompatible(item)
+		}
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			m[fmt.Sprint(key)] = jsonCompatible(item)
+		}
+		return m
+	case []interface{}:
+		for i, item := range v {
+			v[i] = jsonCompatible(item)
+		}
+	}
+	return value
+}
@@ -0,0 +1,83 @@
+/**
+ * Copyright (c) Facebook, Inc. and its affiliates.
+ *
+ * This source code is licensed under the MIT license found in the
+ * LICENSE file in the root directory of this source tree.
+ */
+
+package dhcplb
+
+import (
+	"fmt"
+	"net"
+)
+
+// Policies applied to the v4 requests with a zero giaddr, which come from
+// clients on the same link as dhcplb rather than from a relay.
+const (
+	// ZeroGiaddrDrop drops the packet, the backends would have no way to
+	// reply to the client. This is the default.
+	ZeroGiaddrDrop = "drop"
+	// ZeroGiaddrRelay makes dhcplb act as the first relay: giaddr is set to
+	// Config.Giaddr, and the replies are sent to the client by dhcplb.
+	// Config.Giaddr defaults to listen_addr.
+	ZeroGiaddrRelay = "relay"
+)
+
+// giaddr parses the settings of the v4 requests accepted, depending on their
+// giaddr.
+func (c *configSpec) giaddr() (policy string, giaddr net.IP, subnets []*net.IPNet, err error) {
+	if c.Version != 4 {
+		if c.ZeroGiaddr != "" || c.Giaddr != "" || len(c.RelaySubnets) > 0 {
+			return "", nil, nil, fmt.Errorf("zero_giaddr, giaddr and relay_subnets are only supported in v4")
+		}
+		return "", nil, nil, nil
+	}
+	var errs errorList
+	policy = c.ZeroGiaddr
+	if policy == "" {
+		policy = ZeroGiaddrDrop
+	}
+	if policy != ZeroGiaddrDrop && policy != ZeroGiaddrRelay {
+		errs = errs.add(fmt.Errorf(
+			"'%s' is not a supported zero_giaddr policy, supported policies are: %s, %s",
+			policy, ZeroGiaddrDrop, ZeroGiaddrRelay))
+	}
+	if c.Giaddr != "" {
+		if giaddr = net.ParseIP(c.Giaddr).To4(); giaddr == nil {
+			errs = errs.add(fmt.Errorf("Unable to parse giaddr %s", c.Giaddr))
+		}
+	} else if policy == ZeroGiaddrRelay {
+		// only the packets with a zero giaddr are relayed with it, the
+		// giaddr of the others is only replaced when giaddr is set
+		if giaddr = net.ParseIP(c.ListenAddr).To4(); giaddr == nil || giaddr.IsUnspecified() {
+			giaddr = nil
+			errs = errs.add(fmt.Errorf("giaddr is required to relay packets with a zero giaddr when listen_addr isn't an IPv4 address"))
+		}
+	}
+	for _, subnet := range c.RelaySubnets {
+		_, network, err := net.ParseCIDR(subnet)
+		if err != nil {
+			errs = errs.add(fmt.Errorf("Invalid relay_subnets entry %s: %s", subnet, err))
+			continue
+		}
+		subnets = append(subnets, network)
+	}
+	if len(errs) > 0 {
+		return "", nil, nil, errs
+	}
+	return policy, giaddr, subnets, nil
+}
+
+// relayAllowed returns true if a v4 request relayed by giaddr must be served.
+func (c *Config) relayAllowed(giaddr net.IP) bool {
+	if len(c.RelaySubnets) == 0 {
+		return true
+	}
+	for _, subnet := range c.RelaySubnets {
+		if subnet.Contains(giaddr) {
+			return true
+		}
+	}
+	return false
+}
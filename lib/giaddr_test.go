@@ -0,0 +1,119 @@
+/**
+ * Copyright (c) Facebook, Inc. and its affiliates.
+ *
+ * This source code is licensed under the MIT license found in the
+ * LICENSE file in the root directory of this source tree.
+ */
+
+package dhcplb
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+func TestGiaddrSpec(t *testing.T) {
+	for _, spec := range []configSpec{
+		{Version: 4, ListenAddr: "0.0.0.0", ZeroGiaddr: "forward"},
+		{Version: 4, ListenAddr: "0.0.0.0", ZeroGiaddr: ZeroGiaddrRelay},
+		{Version: 4, ListenAddr: "0.0.0.0", Giaddr: "fd00::1"},
+		{Version: 4, ListenAddr: "0.0.0.0", RelaySubnets: []string{"10.0.0.0"}},
+		{Version: 6, ListenAddr: "::", RelaySubnets: []string{"fd00::/64"}},
+	} {
+		if _, _, _, err := spec.giaddr(); err == nil {
+			t.Fatalf("Expected an error for %+v", spec)
+		}
+	}
+
+	spec := configSpec{Version: 4, ListenAddr: "10.0.0.5", ZeroGiaddr: ZeroGiaddrRelay}
+	policy, giaddr, _, err := spec.giaddr()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy != ZeroGiaddrRelay || !giaddr.Equal(net.ParseIP("10.0.0.5")) {
+		t.Fatalf("Expected giaddr to default to listen_addr, got %s", giaddr)
+	}
+	// without the relay policy, giaddr is only rewritten when set explicitly
+	spec = configSpec{Version: 4, ListenAddr: "10.0.0.5"}
+	if _, giaddr, _, err = spec.giaddr(); err != nil || giaddr != nil {
+		t.Fatalf("Expected no giaddr, got %s (%v)", giaddr, err)
+	}
+}
+
+func TestGiaddrEnforcement(t *testing.T) {
+	server, logs, cleanup := newLoggedTestServer(t, 4)
+	defer cleanup()
+	_, subnet, _ := net.ParseCIDR("10.0.0.0/24")
+	server.config.RelaySubnets = []*net.IPNet{subnet}
+	peer := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 67}
+	send := func(giaddr string) string {
+		packet, err := dhcpv4.FromBytes(newTestDiscover(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+		packet.GatewayIPAddr = net.ParseIP(giaddr).To4()
+		server.handlePacket(context.Background(), packet.ToBytes(), peer)
+		return <-logs
+	}
+
+	if name := send("0.0.0.0"); name != ErrGi0 {
+		t.Fatalf("Expected %s, got %q", ErrGi0, name)
+	}
+	// clients which already have an address are exempt, eg when renewing
+	request, err := dhcpv4.NewDiscovery(net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff},
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeRequest),
+		dhcpv4.WithClientIP(net.ParseIP("10.2.0.5")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.handlePacket(context.Background(), request.ToBytes(), &net.UDPAddr{IP: request.ClientIPAddr, Port: 68})
+	if name := <-logs; name != "" {
+		t.Fatalf("Expected the packet with a ciaddr to be forwarded, got %s", name)
+	}
+	if name := send("10.1.0.1"); name != ErrGiaddr {
+		t.Fatalf("Expected %s, got %q", ErrGiaddr, name)
+	}
+	if name := send("10.0.0.1"); name != "" {
+		t.Fatalf("Expected the packet to be forwarded, got %s", name)
+	}
+
+	server.config.ZeroGiaddr = ZeroGiaddrRelay
+	server.config.Giaddr = net.ParseIP("127.0.0.1").To4()
+	if name := send("0.0.0.0"); name != "" {
+		t.Fatalf("Expected the packet to be relayed, got %s", name)
+	}
+	// and the reply is sent to the client
+	reply, err := dhcpv4.New(dhcpv4.WithReply(&dhcpv4.DHCPv4{}), dhcpv4.WithGatewayIP(server.config.Giaddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr := replyDestination(reply, server.config.Giaddr).String(); addr != "255.255.255.255:68" {
+		t.Fatalf("Expected the reply to be broadcast, got %s", addr)
+	}
+}
+
+func TestRelayAddrV4(t *testing.T) {
+	for _, tt := range []struct {
+		giaddr, ciaddr string
+		want           net.IP
+	}{
+		{"10.0.0.1", "0.0.0.0", net.ParseIP("10.0.0.1")},
+		{"10.0.0.1", "10.2.0.5", net.ParseIP("10.0.0.1")},
+		// the client's network when it wasn't relayed
+		{"0.0.0.0", "10.2.0.5", net.ParseIP("10.2.0.5")},
+		{"0.0.0.0", "0.0.0.0", nil},
+	} {
+		packet, err := dhcpv4.New(
+			dhcpv4.WithGatewayIP(net.ParseIP(tt.giaddr)),
+			dhcpv4.WithClientIP(net.ParseIP(tt.ciaddr)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := relayAddrV4(packet); !got.Equal(tt.want) {
+			t.Fatalf("giaddr %s, ciaddr %s: expected %s, got %s", tt.giaddr, tt.ciaddr, tt.want, got)
+		}
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"fmt"
 	"net"
 	"runtime/debug"
+	"strings"
 	"time"
 
 	"github.com/golang/glog"
@@ -24,99 +25,206 @@ import (
 
 // List of possible errors.
 const (
-	ErrUnknown  = "E_UNKNOWN"
-	ErrPanic    = "E_PANIC"
-	ErrRead     = "E_READ"
-	ErrConnect  = "E_CONN"
-	ErrWrite    = "E_WRITE"
-	ErrGi0      = "E_GI_0"
-	ErrParse    = "E_PARSE"
-	ErrNoServer = "E_NO_SERVER"
-	ErrConnRate = "E_CONN_RATE"
+	ErrUnknown       = "E_UNKNOWN"
+	ErrPanic         = "E_PANIC"
+	ErrRead          = "E_READ"
+	ErrConnect       = "E_CONN"
+	ErrWrite         = "E_WRITE"
+	ErrGi0           = "E_GI_0"
+	ErrGiaddr        = "E_GIADDR"
+	ErrParse         = "E_PARSE"
+	ErrNoServer      = "E_NO_SERVER"
+	ErrConnRate      = "E_CONN_RATE"
+	ErrQueue         = "E_QUEUE_FULL"
+	ErrFallback      = "E_OVERRIDE_FALLBACK"
+	ErrRelayInfo     = "E_RELAY_INFO"
+	ErrUnknownServer = "E_UNKNOWN_SERVER"
+	ErrMaxHops       = "E_MAX_HOPS"
+	ErrLoop          = "E_LOOP"
+	ErrRelayMiss     = "E_RELAY_MISS"
 )
 
-func (s *Server) handleConnection(ctx context.Context) {
-	buffer := make([]byte, s.config.PacketBufSize)
-	bytesRead, peer, err := s.conn.ReadFromUDP(buffer)
+func (s *Server) handleConnection(ctx context.Context, conn *net.UDPConn) {
+	buffer := s.getBuffer()
+	bytesRead, peer, err := conn.ReadFromUDP(*buffer)
+	if s.isStopping() {
+		// the read deadline was set because we are shutting down
+		s.putBuffer(buffer)
+		return
+	}
 	if err != nil || bytesRead == 0 {
+		s.putBuffer(buffer)
 		msg := "error reading from %s: %v"
 		glog.Errorf(msg, peer, err)
 		s.logger.LogErr(time.Now(), nil, nil, peer, ErrRead, err)
 		return
 	}
 
+	*buffer = (*buffer)[:bytesRead]
+	s.dispatch(ctx, buffer, peer)
+}
+
+// getBuffer returns a buffer of Config.PacketBufSize bytes to read a packet
+// into. It comes from a pool so that we don't allocate one for every packet.
+func (s *Server) getBuffer() *[]byte {
+	size := s.GetConfig().PacketBufSize
+	buffer, ok := s.buffers.Get().(*[]byte)
+	if !ok || cap(*buffer) < size {
+		// the pool is empty, or the buffer size was increased by a reload
+		b := make([]byte, size)
+		return &b
+	}
+	*buffer = (*buffer)[:size]
+	return buffer
+}
+
+// putBuffer returns a buffer to the pool once the packet it holds has been
+// handled, nothing must reference it afterwards.
+func (s *Server) putBuffer(buffer *[]byte) {
+	s.buffers.Put(buffer)
+}
+
+// dispatch hands a packet which was just read over to the worker pool, or to
+// a new goroutine. The buffer is returned to the pool once handled.
+func (s *Server) dispatch(ctx context.Context, buffer *[]byte, peer *net.UDPAddr) {
+	s.inflight.Add(1)
+	if s.workers != nil {
+		s.workers.enqueue(s, &rawPacket{buffer, peer, time.Now()})
+		return
+	}
 	go func() {
-		defer func() {
-			if r := recover(); r != nil {
-				glog.Errorf("Panicked handling v%d packet from %s: %s", s.config.Version, peer, r)
-				glog.Errorf("Offending packet: %x", buffer[:bytesRead])
-				err, _ := r.(error)
-				s.logger.LogErr(time.Now(), nil, nil, peer, ErrPanic, err)
-				glog.Errorf("%s: %s", r, debug.Stack())
-			}
-		}()
+		defer s.inflight.Done()
+		s.handlePacket(ctx, *buffer, peer)
+		s.putBuffer(buffer)
+	}()
+}
 
-		if s.config.Version == 4 {
-			s.handleRawPacketV4(ctx, buffer[:bytesRead], peer)
-		} else if s.config.Version == 6 {
-			s.handleRawPacketV6(ctx, buffer[:bytesRead], peer)
+// writeTo sends a packet, batching it with the ones sent concurrently if
+// Config.BatchSize is set.
+func (s *Server) writeTo(buffer []byte, addr *net.UDPAddr) error {
+	if s.writer != nil {
+		return s.writer.write(buffer, addr)
+	}
+	_, err := s.conn.WriteTo(buffer, addr)
+	return err
+}
+
+func (s *Server) handlePacket(ctx context.Context, buffer []byte, peer *net.UDPAddr) {
+	// the config may be reloaded while the packet is handled, all the steps
+	// must use the same one
+	config := s.GetConfig()
+	defer func() {
+		if r := recover(); r != nil {
+			glog.Errorf("Panicked handling v%d packet from %s: %s", config.Version, peer, r)
+			glog.Errorf("Offending packet: %x", buffer)
+			err, _ := r.(error)
+			s.logger.LogErr(time.Now(), nil, nil, peer, ErrPanic, err)
+			glog.Errorf("%s: %s", r, debug.Stack())
 		}
 	}()
+
+	if config.Version == 4 {
+		s.handleRawPacketV4(ctx, config, buffer, peer)
+	} else if config.Version == 6 {
+		s.handleRawPacketV6(ctx, config, buffer, peer)
+	}
 }
 
-func selectDestinationServer(config *Config, message *DHCPMessage) (*DHCPServer, error) {
-	server, err := handleOverride(config, message)
+func (s *Server) selectDestinationServer(start time.Time, config *Config, message *DHCPMessage) (*DHCPServer, error) {
+	server, err := s.handleOverride(start, config, message)
 	if err != nil {
 		glog.Errorf("Error handling override, drop due to: %s", err)
 		return nil, err
 	}
-	if server == nil {
-		server, err = config.Algorithm.SelectRatioBasedDhcpServer(message)
+	if server != nil {
+		// overridden hosts and tiers may not be in the server lists, remember
+		// them to accept their replies
+		s.sentToOverride(server)
+		return server, nil
+	}
+	server, err = config.Algorithm.SelectRatioBasedDhcpServer(message)
+	if err != nil {
+		return nil, err
 	}
-	return server, err
+	server = s.steer(config, server, message)
+	s.affinity.record(message.ClientID, server)
+	return server, nil
 }
 
-func handleOverride(config *Config, message *DHCPMessage) (*DHCPServer, error) {
-	if override, ok := config.Overrides[message.Mac.String()]; ok {
-		// Checking if override is expired. If so, ignore it. Expiration field should
-		// be a timestamp in the following format "2006/01/02 15:04 -0700".
-		// For example, a timestamp in UTC would look as follows: "2017/05/06 14:00 +0000".
-		var err error
-		var expiration time.Time
-		if override.Expiration != "" {
-			expiration, err = time.Parse("2006/01/02 15:04 -0700", override.Expiration)
-			if err != nil {
-				glog.Errorf("Could not parse override expiration for MAC %s: %s", message.Mac.String(), err.Error())
-				return nil, nil
-			}
-			if time.Now().After(expiration) {
-				glog.Errorf("Override rule for MAC %s expired on %s, ignoring", message.Mac.String(), expiration.Local())
-				return nil, nil
-			}
-		}
-		if override.Expiration == "" {
-			glog.Infof("Found override rule for %s without expiration", message.Mac.String())
-		} else {
-			glog.Infof("Found override rule for %s, it will expire on %s", message.Mac.String(), expiration.Local())
-		}
+func (s *Server) handleOverride(start time.Time, config *Config, message *DHCPMessage) (*DHCPServer, error) {
+	override, ok := s.admin.override(message.Mac.String())
+	if ok {
+		glog.Infof("Found temporary override rule for %s", message.Mac.String())
+	} else {
+		override, ok = findOverride(config, message)
+	}
+	if !ok {
+		return nil, nil
+	}
 
-		var server *DHCPServer
-		if len(override.Host) > 0 {
-			server, err = handleHostOverride(config, override.Host)
-		} else if len(override.Tier) > 0 {
-			server, err = handleTierOverride(config, override.Tier, message)
-		}
-		if err != nil {
-			return nil, err
-		}
-		if server != nil {
-			return server, nil
+	// with a fallback, servers which are down count as unavailable
+	var available func(*DHCPServer) bool
+	if override.Fallback != "" && override.Fallback != FallbackDrop {
+		available = s.isAvailable
+	}
+	var server *DHCPServer
+	var err error
+	if len(override.Host) > 0 {
+		server, err = handleHostOverride(config, override.Host)
+		if err == nil && available != nil && !available(server) {
+			err = fmt.Errorf("Overridden host %s is unavailable", override.Host)
 		}
-		glog.Infof("Override didn't have host or tier, this shouldn't happen, proceeding with normal server selection")
+	} else if len(override.Tier) > 0 {
+		server, err = handleTierOverride(config, override.Tier, message, available)
+	}
+	if err != nil {
+		return s.overrideFallback(start, config, override, message, err)
+	}
+	if server != nil {
+		return server, nil
 	}
+	glog.Infof("Override didn't have host or tier, this shouldn't happen, proceeding with normal server selection")
 	return nil, nil
 }
 
+// overrideFallback applies the fallback policy of an override whose host or
+// tier couldn't be used. It returns a nil server and error to proceed with
+// normal server selection. The packet is still forwarded, so the fallback is
+// logged as an event rather than as an error.
+func (s *Server) overrideFallback(start time.Time, config *Config, override Override, message *DHCPMessage, err error) (*DHCPServer, error) {
+	switch {
+	case override.Fallback == "" || override.Fallback == FallbackDrop:
+		return nil, err
+	case override.Fallback == FallbackDefault:
+		glog.Infof("%s, falling back to normal server selection", err)
+		s.logger.LogEvent(start, nil, nil, message.Peer, ErrFallback, err)
+		return nil, nil
+	}
+	tier := strings.TrimPrefix(override.Fallback, FallbackTierPrefix)
+	glog.Infof("%s, falling back to tier %s", err, tier)
+	s.logger.LogEvent(start, nil, nil, message.Peer, ErrFallback, err)
+	server, err := handleTierOverride(config, tier, message, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Fallback tier %s: %s", tier, err)
+	}
+	return server, nil
+}
+
+// findOverride returns the most specific active override matching message.
+func findOverride(config *Config, message *DHCPMessage) (Override, bool) {
+	keys := config.activeOverrides.candidates(message)
+	if len(keys) == 0 {
+		return Override{}, false
+	}
+	override := config.Overrides[keys[0]]
+	if override.Expiration == "" {
+		glog.Infof("Found override rule %s for %s without expiration", keys[0], message.Mac.String())
+	} else {
+		glog.Infof("Found override rule %s for %s, it will expire on %s", keys[0], message.Mac.String(), override.expirationTime.Local())
+	}
+	return override, true
+}
+
 func handleHostOverride(config *Config, host string) (*DHCPServer, error) {
 	addr := net.ParseIP(host)
 	if addr == nil {
@@ -130,11 +238,22 @@ func handleHostOverride(config *Config, host string) (*DHCPServer, error) {
 	return server, nil
 }
 
-func handleTierOverride(config *Config, tier string, message *DHCPMessage) (*DHCPServer, error) {
+// handleTierOverride picks a server of tier. If available isn't nil, only the
+// servers for which it returns true are considered.
+func handleTierOverride(config *Config, tier string, message *DHCPMessage, available func(*DHCPServer) bool) (*DHCPServer, error) {
 	servers, err := config.HostSourcer.GetServersFromTier(tier)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to get servers from tier: %s", err)
 	}
+	if available != nil {
+		filtered := make([]*DHCPServer, 0, len(servers))
+		for _, server := range servers {
+			if available(server) {
+				filtered = append(filtered, server)
+			}
+		}
+		servers = filtered
+	}
 	if len(servers) == 0 {
 		return nil, fmt.Errorf("Sourcer returned no servers")
 	}
@@ -150,13 +269,14 @@ func (s *Server) sendToServer(start time.Time, server *DHCPServer, packet []byte
 
 	// Check for connection rate
 	ok, err := s.throttle.OK(server.Address.String())
+	s.throttleSize.Set(float64(s.throttle.len()))
 	if !ok {
 		glog.Errorf("Error writing to server %s, drop due to throttling", server.Hostname)
 		s.logger.LogErr(time.Now(), server, packet, peer, ErrConnRate, err)
 		return err
 	}
 
-	_, err = s.conn.WriteTo(packet, server.udpAddr())
+	err = s.writeTo(packet, server.udpAddr())
 	if err != nil {
 		glog.Errorf("Error writing to server %s, drop due to %s", server.Hostname, err)
 		s.logger.LogErr(start, server, packet, peer, ErrWrite, err)
@@ -168,7 +288,7 @@ func (s *Server) sendToServer(start time.Time, server *DHCPServer, packet []byte
 	return nil
 }
 
-func (s *Server) handleRawPacketV4(ctx context.Context, buffer []byte, peer *net.UDPAddr) {
+func (s *Server) handleRawPacketV4(ctx context.Context, config *Config, buffer []byte, peer *net.UDPAddr) {
 	// runs in a separate go routine
 	start := time.Now()
 	var message DHCPMessage
@@ -180,7 +300,43 @@ func (s *Server) handleRawPacketV4(ctx context.Context, buffer []byte, peer *net
 	}
 
 	if s.server {
-		s.handleV4Server(ctx, start, packet, peer)
+		s.handleV4Server(ctx, config, start, buffer, packet, peer)
+		return
+	}
+
+	if packet.OpCode == dhcpv4.OpcodeBootReply {
+		s.handleV4Reply(config, start, buffer, packet, peer)
+		return
+	}
+
+	// dhcplb is the relay of the client, giaddr is only set once the packet
+	// was matched against the overrides and relay_subnets
+	relayClient := false
+	if packet.GatewayIPAddr.IsUnspecified() {
+		switch {
+		case !packet.ClientIPAddr.IsUnspecified():
+			// clients renewing, rebinding or releasing their address, or
+			// sending an INFORM, already have one: the backends reply to
+			// ciaddr
+		case config.ZeroGiaddr == ZeroGiaddrRelay:
+			relayClient = true
+		default:
+			err := errors.New("giaddr is 0, the backend couldn't reply to the client")
+			glog.Errorf("%s, Drop due to %s", packet.Summary(), err)
+			s.logger.LogErr(start, nil, buffer, peer, ErrGi0, err)
+			return
+		}
+	} else if !config.relayAllowed(packet.GatewayIPAddr) {
+		err := fmt.Errorf("giaddr %s isn't in relay_subnets", packet.GatewayIPAddr)
+		glog.Errorf("%s, Drop due to %s", packet.Summary(), err)
+		s.logger.LogErr(start, nil, buffer, peer, ErrGiaddr, err)
+		return
+	}
+
+	if maxHops := config.MaxHops; int(packet.HopCount) >= maxHops {
+		err := fmt.Errorf("hop count %d reached the limit of %d", packet.HopCount, maxHops)
+		glog.Errorf("%s, Drop due to %s", packet.Summary(), err)
+		s.logger.LogErr(start, nil, buffer, peer, ErrMaxHops, err)
 		return
 	}
 
@@ -193,36 +349,148 @@ func (s *Server) handleRawPacketV4(ctx context.Context, buffer []byte, peer *net
 	} else {
 		message.Serial = vd.Serial
 	}
+	message.RelayAddr = relayAddrV4(packet)
+	if class := packet.ClassIdentifier(); class != "" {
+		message.VendorClasses = []string{class}
+	}
+	if s.loops.looped(&message, int(packet.HopCount)) {
+		err := errors.New("packet was already forwarded by dhcplb")
+		glog.Errorf("%s, Drop due to %s", packet.Summary(), err)
+		s.logger.LogErr(start, nil, buffer, peer, ErrLoop, err)
+		return
+	}
+
+	// have the replies come back to dhcplb, they are sent to the relay agent
+	// or to the client by handleV4Reply
+	relayThrough := relayClient || config.RewriteGiaddr && !packet.GatewayIPAddr.IsUnspecified() && !packet.GatewayIPAddr.Equal(config.Giaddr)
+	// the relay agent gets back the option 82 it set, not the one of dhcplb
+	original := originalRelay(packet)
+	if rai := config.RelayAgentInfo; rai != nil {
+		if err := rai.insert(packet); err != nil {
+			glog.Errorf("%s, Drop due to %s", packet.Summary(), err)
+			s.logger.LogErr(start, nil, buffer, peer, ErrRelayInfo, err)
+			return
+		}
+	}
+	if relayThrough && config.RewriteGiaddr {
+		s.relays.relayThrough(packet, original, config.Giaddr)
+	} else if relayThrough {
+		packet.GatewayIPAddr = config.Giaddr
+	}
 
 	packet.HopCount++
+	// serialize once, the same bytes are logged and forwarded
+	raw := packet.ToBytes()
 
-	server, err := selectDestinationServer(s.config, &message)
+	server, err := s.selectDestinationServer(start, config, &message)
+	if err != nil {
+		glog.Errorf("%s, Drop due to %s", packet.Summary(), err)
+		s.logger.LogErr(start, nil, raw, peer, ErrNoServer, err)
+		return
+	}
+
+	err = s.sendToServer(start, server, raw, peer)
+	if err == nil {
+		s.loops.forwarded(&message, int(packet.HopCount))
+	}
+	// only the replies to the packets relayed through dhcplb come back to us
+	if err == nil && relayThrough && config.ReplyTracking != nil {
+		s.replies.forwarded(server, message.XID)
+	}
+}
+
+// relayAddrV4 returns an address of the network of the client of a v4
+// request: the giaddr of its relay, or its ciaddr when it wasn't relayed. It's
+// nil for clients on the link of dhcplb which don't have an address yet.
+func relayAddrV4(packet *dhcpv4.DHCPv4) net.IP {
+	switch {
+	case !packet.GatewayIPAddr.IsUnspecified():
+		return packet.GatewayIPAddr
+	case !packet.ClientIPAddr.IsUnspecified():
+		return packet.ClientIPAddr
+	}
+	return nil
+}
+
+// handleV4Reply sends a reply from a backend to the relay agent which
+// forwarded the request, or to the client if the request wasn't relayed.
+func (s *Server) handleV4Reply(config *Config, start time.Time, buffer []byte, packet *dhcpv4.DHCPv4, peer *net.UDPAddr) {
+	if !s.isKnownServer(peer.IP) {
+		err := fmt.Errorf("reply from unknown server %s", peer.IP)
+		glog.Errorf("%s, Drop due to %s", packet.Summary(), err)
+		s.logger.LogErr(start, nil, buffer, peer, ErrUnknownServer, err)
+		return
+	}
+	if config.ReplyTracking != nil {
+		s.replies.replied(peer.IP, packet.TransactionID[:])
+	}
+	addr, err := s.prepareV4Reply(config, packet)
 	if err != nil {
 		glog.Errorf("%s, Drop due to %s", packet.Summary(), err)
-		s.logger.LogErr(start, nil, packet.ToBytes(), peer, ErrNoServer, err)
+		s.logger.LogErr(start, nil, buffer, peer, ErrRelayMiss, err)
+		return
+	}
+	raw := packet.ToBytes()
+	if err := s.writeTo(raw, addr); err != nil {
+		glog.Errorf("Error writing reply to %s, drop due to %s", addr, err)
+		s.logger.LogErr(start, nil, raw, peer, ErrWrite, err)
 		return
 	}
+	s.logger.LogSuccess(start, nil, raw, peer)
+}
 
-	s.sendToServer(start, server, packet.ToBytes(), peer)
+// prepareV4Reply updates a reply from a backend before it's relayed, and
+// returns where it must be sent.
+func (s *Server) prepareV4Reply(config *Config, reply *dhcpv4.DHCPv4) (*net.UDPAddr, error) {
+	// with a rewritten giaddr, the replies can only be relayed if we still
+	// know who the request came from
+	if config.RewriteGiaddr && reply.GatewayIPAddr.Equal(config.Giaddr) && !s.relays.restore(reply) {
+		return nil, errors.New("the request of the reply isn't in the relay table anymore, relay_table_size may be too small")
+	}
+	addr := replyDestination(reply, config.Giaddr)
+	// downstream relays expect their option 82 back, only the replies sent
+	// straight to clients are stripped
+	if rai := config.RelayAgentInfo; rai != nil && addr.Port == dhcpv4.ClientPort {
+		rai.strip(reply)
+	}
+	return addr, nil
 }
 
-func (s *Server) handleV4Server(ctx context.Context, start time.Time, packet *dhcpv4.DHCPv4, peer *net.UDPAddr) {
-	reply, err := s.config.Handler.ServeDHCPv4(ctx, packet)
-	s.logger.LogSuccess(start, nil, packet.ToBytes(), peer)
+// replyDestination returns where a v4 reply must be sent, following RFC 2131
+// section 4.1. Replies to the requests dhcplb relayed itself, with giaddr as
+// their giaddr, are sent to the client.
+func replyDestination(reply *dhcpv4.DHCPv4, giaddr net.IP) *net.UDPAddr {
+	switch {
+	case len(reply.GatewayIPAddr) > 0 && !reply.GatewayIPAddr.IsUnspecified() && !reply.GatewayIPAddr.Equal(giaddr):
+		return &net.UDPAddr{IP: reply.GatewayIPAddr, Port: dhcpv4.ServerPort}
+	case reply.MessageType() == dhcpv4.MessageTypeNak:
+		// NAKs are always broadcast to unrelayed clients
+	case len(reply.ClientIPAddr) > 0 && !reply.ClientIPAddr.IsUnspecified():
+		return &net.UDPAddr{IP: reply.ClientIPAddr, Port: dhcpv4.ClientPort}
+	}
+	// clients without an address yet can only be reached by unicast with
+	// raw sockets, broadcast both when they asked for it and when they didn't
+	return &net.UDPAddr{IP: net.IPv4bcast, Port: dhcpv4.ClientPort}
+}
+
+func (s *Server) handleV4Server(ctx context.Context, config *Config, start time.Time, buffer []byte, packet *dhcpv4.DHCPv4, peer *net.UDPAddr) {
+	reply, err := config.Handler.ServeDHCPv4(ctx, packet)
+	s.logger.LogSuccess(start, nil, buffer, peer)
 	if err != nil {
 		glog.Errorf("Error creating reply %s", err)
-		s.logger.LogErr(start, nil, packet.ToBytes(), peer, fmt.Sprintf("%T", err), err)
+		s.logger.LogErr(start, nil, buffer, peer, fmt.Sprintf("%T", err), err)
 		return
 	}
 	addr := &net.UDPAddr{
 		IP:   packet.GatewayIPAddr,
 		Port: dhcpv4.ServerPort,
 	}
-	s.conn.WriteTo(reply.ToBytes(), addr)
-	s.logger.LogSuccess(start, nil, reply.ToBytes(), peer)
+	raw := reply.ToBytes()
+	s.writeTo(raw, addr)
+	s.logger.LogSuccess(start, nil, raw, peer)
 }
 
-func (s *Server) handleRawPacketV6(ctx context.Context, buffer []byte, peer *net.UDPAddr) {
+func (s *Server) handleRawPacketV6(ctx context.Context, config *Config, buffer []byte, peer *net.UDPAddr) {
 	// runs in a separate go routine
 	start := time.Now()
 	packet, err := dhcpv6.FromBytes(buffer)
@@ -233,12 +501,24 @@ func (s *Server) handleRawPacketV6(ctx context.Context, buffer []byte, peer *net
 	}
 
 	if s.server {
-		s.handleV6Server(ctx, start, packet, peer)
+		s.handleV6Server(ctx, config, start, buffer, packet, peer)
 		return
 	}
 
 	if packet.Type() == dhcpv6.MessageTypeRelayReply {
-		s.handleV6RelayRepl(start, packet, peer)
+		s.handleV6RelayRepl(config, start, buffer, packet, peer)
+		return
+	}
+
+	// hop count of the packet we received, -1 if it comes from a client
+	hops := -1
+	if packet.IsRelay() {
+		hops = int(packet.(*dhcpv6.RelayMessage).HopCount)
+	}
+	if maxHops := config.MaxHops; hops >= maxHops {
+		err := fmt.Errorf("hop count %d reached the limit of %d", hops, maxHops)
+		glog.Errorf("%s, Drop due to %s", packet.Summary(), err)
+		s.logger.LogErr(start, nil, buffer, peer, ErrMaxHops, err)
 		return
 	}
 
@@ -247,7 +527,7 @@ func (s *Server) handleRawPacketV6(ctx context.Context, buffer []byte, peer *net
 	msg, err := packet.GetInnerMessage()
 	if err != nil {
 		glog.Errorf("Error getting inner message: %s", err)
-		s.logger.LogErr(start, nil, packet.ToBytes(), peer, ErrParse, err)
+		s.logger.LogErr(start, nil, buffer, peer, ErrParse, err)
 		return
 	}
 	message.XID = msg.TransactionID[:]
@@ -257,14 +537,14 @@ func (s *Server) handleRawPacketV6(ctx context.Context, buffer []byte, peer *net
 	if duid == nil {
 		errMsg := errors.New("failed to extract Client ID")
 		glog.Errorf("%v", errMsg)
-		s.logger.LogErr(start, nil, packet.ToBytes(), peer, ErrParse, errMsg)
+		s.logger.LogErr(start, nil, buffer, peer, ErrParse, errMsg)
 		return
 	}
 	message.ClientID = duid.ToBytes()
 	mac, err := dhcpv6.ExtractMAC(packet)
 	if err != nil {
 		glog.Errorf("Failed to extract MAC, drop due to %s", err)
-		s.logger.LogErr(start, nil, packet.ToBytes(), peer, ErrParse, err)
+		s.logger.LogErr(start, nil, buffer, peer, ErrParse, err)
 		return
 	}
 	message.Mac = mac
@@ -273,27 +553,67 @@ func (s *Server) handleRawPacketV6(ctx context.Context, buffer []byte, peer *net
 	} else {
 		message.Serial = vendorData.Serial
 	}
+	message.RelayAddr = relayLinkAddr(packet)
+	for _, class := range msg.Options.VendorClasses() {
+		for _, data := range class.Data {
+			message.VendorClasses = append(message.VendorClasses, string(data))
+		}
+	}
+	if s.loops.looped(&message, hops) {
+		err := errors.New("packet was already forwarded by dhcplb")
+		glog.Errorf("%s, Drop due to %s", packet.Summary(), err)
+		s.logger.LogErr(start, nil, buffer, peer, ErrLoop, err)
+		return
+	}
 
-	server, err := selectDestinationServer(s.config, &message)
+	server, err := s.selectDestinationServer(start, config, &message)
 	if err != nil {
 		glog.Errorf("%s, Drop due to %s", packet.Summary(), err)
-		s.logger.LogErr(start, nil, packet.ToBytes(), peer, ErrNoServer, err)
+		s.logger.LogErr(start, nil, buffer, peer, ErrNoServer, err)
 		return
 	}
 
-	relayMsg, _ := dhcpv6.EncapsulateRelay(packet, dhcpv6.MessageTypeRelayForward, net.IPv6zero, peer.IP)
-	s.sendToServer(start, server, relayMsg.ToBytes(), peer)
+	relayMsg := encapsulateRelay(config.RelayOptions, packet, peer.IP)
+	err = s.sendToServer(start, server, relayMsg.ToBytes(), peer)
+	if err == nil {
+		s.loops.forwarded(&message, int(relayMsg.HopCount))
+	}
+	if err == nil && config.ReplyTracking != nil {
+		s.replies.forwarded(server, message.XID)
+	}
+}
+
+// relayLinkAddr returns the link-address set by the relay closest to the
+// client, nil if the packet wasn't relayed or the link-address wasn't set.
+func relayLinkAddr(packet dhcpv6.DHCPv6) net.IP {
+	var linkAddr net.IP
+	for packet.IsRelay() {
+		relay := packet.(*dhcpv6.RelayMessage)
+		if !relay.LinkAddr.IsUnspecified() {
+			linkAddr = relay.LinkAddr
+		}
+		packet = relay.Options.RelayMessage()
+		if packet == nil {
+			break
+		}
+	}
+	return linkAddr
 }
 
-func (s *Server) handleV6RelayRepl(start time.Time, packet dhcpv6.DHCPv6, peer *net.UDPAddr) {
+func (s *Server) handleV6RelayRepl(config *Config, start time.Time, buffer []byte, packet dhcpv6.DHCPv6, peer *net.UDPAddr) {
 	// when we get a relay-reply, we need to unwind the message, removing the top
 	// relay-reply info and passing on the inner part of the message
 	msg, err := dhcpv6.DecapsulateRelay(packet)
 	if err != nil {
 		glog.Errorf("Failed to decapsulate packet, drop due to %s", err)
-		s.logger.LogErr(start, nil, packet.ToBytes(), peer, ErrParse, err)
+		s.logger.LogErr(start, nil, buffer, peer, ErrParse, err)
 		return
 	}
+	if config.ReplyTracking != nil {
+		if inner, err := packet.GetInnerMessage(); err == nil {
+			s.replies.replied(peer.IP, inner.TransactionID[:])
+		}
+	}
 	peerAddr := packet.(*dhcpv6.RelayMessage).PeerAddr
 	// send the packet to the peer addr
 	addr := &net.UDPAddr{
@@ -301,29 +621,30 @@ func (s *Server) handleV6RelayRepl(start time.Time, packet dhcpv6.DHCPv6, peer *
 		Port: dhcpv6.DefaultServerPort,
 		Zone: "",
 	}
-	conn, err := net.DialUDP("udp", s.config.ReplyAddr, addr)
+	conn, err := net.DialUDP("udp", config.ReplyAddr, addr)
 	if err != nil {
 		glog.Errorf("Error creating udp connection %s", err)
-		s.logger.LogErr(start, nil, packet.ToBytes(), peer, ErrConnect, err)
+		s.logger.LogErr(start, nil, buffer, peer, ErrConnect, err)
 		return
 	}
 	conn.Write(msg.ToBytes())
-	s.logger.LogSuccess(start, nil, packet.ToBytes(), peer)
+	s.logger.LogSuccess(start, nil, buffer, peer)
 	conn.Close()
 }
 
-func (s *Server) handleV6Server(ctx context.Context, start time.Time, packet dhcpv6.DHCPv6, peer *net.UDPAddr) {
-	reply, err := s.config.Handler.ServeDHCPv6(ctx, packet)
-	s.logger.LogSuccess(start, nil, packet.ToBytes(), peer)
+func (s *Server) handleV6Server(ctx context.Context, config *Config, start time.Time, buffer []byte, packet dhcpv6.DHCPv6, peer *net.UDPAddr) {
+	reply, err := config.Handler.ServeDHCPv6(ctx, packet)
+	s.logger.LogSuccess(start, nil, buffer, peer)
 	if err != nil {
 		glog.Errorf("Error creating reply %s", err)
-		s.logger.LogErr(start, nil, packet.ToBytes(), peer, fmt.Sprintf("%T", err), err)
+		s.logger.LogErr(start, nil, buffer, peer, fmt.Sprintf("%T", err), err)
 		return
 	}
 	addr := &net.UDPAddr{
 		IP:   peer.IP,
 		Port: dhcpv6.DefaultServerPort,
 	}
-	s.conn.WriteTo(reply.ToBytes(), addr)
-	s.logger.LogSuccess(start, nil, reply.ToBytes(), peer)
+	raw := reply.ToBytes()
+	s.writeTo(raw, addr)
+	s.logger.LogSuccess(start, nil, raw, peer)
 }
@@ -0,0 +1,180 @@
+/**
+ * Copyright (c) Facebook, Inc. and its affiliates.
+ *
+ * This source code is licensed under the MIT license found in the
+ * LICENSE file in the root directory of this source tree.
+ */
+
+package dhcplb
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+func newTestDiscover(t testing.TB) []byte {
+	discover, err := dhcpv4.NewDiscovery(net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff})
+	if err != nil {
+		t.Fatalf("Failed to create discover: %s", err)
+	}
+	discover.GatewayIPAddr = net.ParseIP("10.0.0.1")
+	return discover.ToBytes()
+}
+
+// benchmarkRelay measures the allocations made to relay a packet, from getting
+// a buffer to read it into until the buffer is returned to the pool.
+func benchmarkRelay(b *testing.B, version int, packet []byte, peer *net.UDPAddr) {
+	backend := newTestBackend(b, version)
+	defer backend.conn.Close()
+	server := newTestServer(b, newTestConfig(version, []*DHCPServer{backend.server()}))
+	defer server.conn.Close()
+	ctx := context.Background()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buffer := server.getBuffer()
+		*buffer = (*buffer)[:copy(*buffer, packet)]
+		server.handlePacket(ctx, *buffer, peer)
+		server.putBuffer(buffer)
+	}
+}
+
+func BenchmarkRelayAllocsV4(b *testing.B) {
+	peer := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 67}
+	benchmarkRelay(b, 4, newTestDiscover(b), peer)
+}
+
+func BenchmarkRelayAllocsV6(b *testing.B) {
+	peer := &net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 546}
+	benchmarkRelay(b, 6, newTestSolicit(b), peer)
+}
+
+func TestBufferPool(t *testing.T) {
+	server := &Server{config: &Config{PacketBufSize: 16}}
+	buffer := server.getBuffer()
+	if len(*buffer) != 16 {
+		t.Fatalf("Expected a buffer of 16 bytes, got %d", len(*buffer))
+	}
+	*buffer = (*buffer)[:3]
+	server.putBuffer(buffer)
+
+	// buffers are resized to the configured size when reused
+	if buffer = server.getBuffer(); len(*buffer) != 16 {
+		t.Fatalf("Expected a buffer of 16 bytes, got %d", len(*buffer))
+	}
+	server.putBuffer(buffer)
+
+	// and replaced if the configured size grew
+	server.config = &Config{PacketBufSize: 32}
+	if buffer = server.getBuffer(); len(*buffer) != 32 {
+		t.Fatalf("Expected a buffer of 32 bytes, got %d", len(*buffer))
+	}
+}
+
+func TestReplyDestination(t *testing.T) {
+	mac := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+	for _, tt := range []struct {
+		name      string
+		modifiers []dhcpv4.Modifier
+		expected  string
+	}{
+		{"relayed", []dhcpv4.Modifier{dhcpv4.WithGatewayIP(net.ParseIP("10.0.0.1"))}, "10.0.0.1:67"},
+		{"renewing", []dhcpv4.Modifier{dhcpv4.WithClientIP(net.ParseIP("10.0.0.2"))}, "10.0.0.2:68"},
+		{"nak", []dhcpv4.Modifier{dhcpv4.WithClientIP(net.ParseIP("10.0.0.2")), dhcpv4.WithMessageType(dhcpv4.MessageTypeNak)}, "255.255.255.255:68"},
+		{"broadcast", []dhcpv4.Modifier{dhcpv4.WithBroadcast(true)}, "255.255.255.255:68"},
+		{"no address", nil, "255.255.255.255:68"},
+	} {
+		reply, err := dhcpv4.New(append([]dhcpv4.Modifier{
+			dhcpv4.WithReply(&dhcpv4.DHCPv4{ClientHWAddr: mac}),
+			dhcpv4.WithMessageType(dhcpv4.MessageTypeOffer),
+		}, tt.modifiers...)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if addr := replyDestination(reply, nil).String(); addr != tt.expected {
+			t.Fatalf("%s: expected %s, got %s", tt.name, tt.expected, addr)
+		}
+	}
+}
+
+// recordingLogger is a PersonalizedLogger keeping the error names logged.
+type recordingLogger chan string
+
+func (l recordingLogger) Log(msg LogMessage) error {
+	l <- msg.ErrorName
+	return nil
+}
+
+func TestV4ReplyFromKnownServers(t *testing.T) {
+	backend := NewDHCPServer("backend", net.ParseIP("127.0.0.2"), 67)
+	logs := make(recordingLogger, 1)
+	server, err := NewServer(newTestConfig(4, nil), false, logs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.conn.Close()
+
+	discover, err := dhcpv4.FromBytes(newTestDiscover(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := dhcpv4.NewReplyFromRequest(discover,
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeOffer),
+		// reachable from the loopback socket of the server
+		dhcpv4.WithGatewayIP(net.ParseIP("127.0.0.3")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := &net.UDPAddr{IP: backend.Address, Port: 67}
+	server.handlePacket(context.Background(), reply.ToBytes(), peer)
+	if name := <-logs; name != ErrUnknownServer {
+		t.Fatalf("Expected %s for a reply from an unknown server, got %q", ErrUnknownServer, name)
+	}
+
+	server.health.setServers([]*DHCPServer{backend})
+	server.handlePacket(context.Background(), reply.ToBytes(), peer)
+	if name := <-logs; name != "" {
+		t.Fatalf("Expected the reply to be relayed, got %s", name)
+	}
+}
+
+func TestV4ReplyRelayAgentInfo(t *testing.T) {
+	config := newTestConfig(4, nil)
+	config.Giaddr = net.ParseIP("10.0.0.254").To4()
+	config.RelayAgentInfo = &RelayAgentInfoConfig{Policy: RelayInfoKeep, StripReplies: true}
+	relays, err := newRelayTable(config.RelayTableSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{config: config, relays: relays}
+
+	for _, tt := range []struct {
+		giaddr   string
+		stripped bool
+	}{
+		// downstream relays expect their option 82 back
+		{"10.1.0.1", false},
+		// dhcplb relayed the request itself, the reply goes to the client
+		{"10.0.0.254", true},
+		{"0.0.0.0", true},
+	} {
+		reply, err := dhcpv4.New(
+			dhcpv4.WithMessageType(dhcpv4.MessageTypeOffer),
+			dhcpv4.WithGatewayIP(net.ParseIP(tt.giaddr)),
+			dhcpv4.WithOption(dhcpv4.OptRelayAgentInfo(
+				dhcpv4.OptGeneric(dhcpv4.AgentCircuitIDSubOption, []byte("circuit")))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := server.prepareV4Reply(config, reply); err != nil {
+			t.Fatal(err)
+		}
+		if stripped := reply.RelayAgentInfo() == nil; stripped != tt.stripped {
+			t.Fatalf("giaddr %s: expected option 82 stripped=%v", tt.giaddr, tt.stripped)
+		}
+	}
+}
@@ -0,0 +1,336 @@
+/**
+ * Copyright (c) Facebook, Inc. and its affiliates.
+ *
+ * This source code is licensed under the MIT license found in the
+ * LICENSE file in the root directory of this source tree.
+ */
+
+package dhcplb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+// Supported health check probe types.
+const (
+	// ProbeDHCP sends a synthetic relayed DHCPINFORM (v4) or
+	// Information-Request (v6) carrying an RFC 8357 relay source port and
+	// expects a reply from the backend within the timeout.
+	ProbeDHCP = "dhcp"
+	// ProbeUDP sends the same synthetic packet but only treats the backend as
+	// down when the kernel reports the port as unreachable. Use it with
+	// backends which don't support RFC 8357 and always reply to port 67/547.
+	ProbeUDP = "udp"
+)
+
+const (
+	defaultHealthCheckInterval = 10 * time.Second
+	defaultHealthCheckTimeout  = time.Second
+	defaultHealthCheckRise     = 2
+	defaultHealthCheckFall     = 3
+)
+
+// relaySourcePortSubOption is the RFC 8357 Relay Source Port sub-option of
+// the DHCPv4 Relay Agent Information option.
+const relaySourcePortSubOption = dhcpv4.GenericOptionCode(19)
+
+// HealthCheckConfig holds the settings used to actively probe backend DHCP
+// servers.
+type HealthCheckConfig struct {
+	Interval time.Duration
+	Timeout  time.Duration
+	// Rise is the number of consecutive successful probes needed to put an
+	// unhealthy server back in rotation.
+	Rise int
+	// Fall is the number of consecutive failed probes after which a server
+	// is taken out of rotation.
+	Fall  int
+	Probe string
+	// RelayAddr is used as giaddr (v4) or link-address (v6) in the probes,
+	// the local address of the probe socket is used when nil.
+	RelayAddr net.IP
+}
+
+type healthState struct {
+	healthy   bool
+	successes int
+	failures  int
+}
+
+// healthChecker keeps track of the health of the backend servers handed out
+// by the DHCPServerSourcer and probes them periodically.
+type healthChecker struct {
+	lock    sync.RWMutex
+	servers map[serverKey]*DHCPServer
+	states  map[serverKey]*healthState
+	probe   func(ctx context.Context, config *Config, server *DHCPServer) error
+	// changed is signaled when a server changes state, so that the server
+	// lists can be updated without waiting for the next update interval.
+	changed chan struct{}
+}
+
+func newHealthChecker() *healthChecker {
+	return &healthChecker{
+		servers: make(map[serverKey]*DHCPServer),
+		states:  make(map[serverKey]*healthState),
+		probe:   probeServer,
+		changed: make(chan struct{}, 1),
+	}
+}
+
+func keyFor(server *DHCPServer) serverKey {
+	return serverKey{server.Address.String(), server.Port}
+}
+
+// setServers updates the list of servers to be probed. New servers are
+// considered healthy until proven otherwise.
+func (h *healthChecker) setServers(servers []*DHCPServer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	current := make(map[serverKey]*DHCPServer, len(servers))
+	for _, server := range servers {
+		key := keyFor(server)
+		current[key] = server
+		if _, ok := h.states[key]; !ok {
+			h.states[key] = &healthState{healthy: true}
+		}
+	}
+	for key := range h.states {
+		if _, ok := current[key]; !ok {
+			delete(h.states, key)
+		}
+	}
+	h.servers = current
+}
+
+// knows returns true if one of the servers being tracked has address ip.
+func (h *healthChecker) knows(ip net.IP) bool {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	for _, server := range h.servers {
+		if server.Address.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// isHealthy returns false only for servers which failed their health checks,
+// servers that are not being tracked are assumed to be healthy.
+func (h *healthChecker) isHealthy(server *DHCPServer) bool {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	state, ok := h.states[keyFor(server)]
+	return !ok || state.healthy
+}
+
+// record updates the state of a server with the result of a probe and
+// returns true if the server went up or down.
+func (h *healthChecker) record(server *DHCPServer, err error, config *HealthCheckConfig) bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	state, ok := h.states[keyFor(server)]
+	if !ok {
+		// server was removed while being probed
+		return false
+	}
+	if err != nil {
+		state.successes = 0
+		state.failures++
+		if state.healthy && state.failures >= config.Fall {
+			state.healthy = false
+			glog.Errorf("Server %s failed %d health checks, removing it: %s", server, state.failures, err)
+			return true
+		}
+		glog.V(2).Infof("Health check failed for server %s: %s", server, err)
+		return false
+	}
+	state.failures = 0
+	state.successes++
+	if !state.healthy && state.successes >= config.Rise {
+		state.healthy = true
+		glog.Infof("Server %s passed %d health checks, adding it back", server, state.successes)
+		return true
+	}
+	return false
+}
+
+// run probes all the known servers every HealthCheckConfig.Interval. Health
+// checking can be turned on and off with a config reload.
+func (h *healthChecker) run(ctx context.Context, s *Server) {
+	for {
+		config := s.GetConfig()
+		interval := defaultHealthCheckInterval
+		if config.HealthCheck != nil {
+			interval = config.HealthCheck.Interval
+			h.checkAll(config)
+		} else {
+			h.reset()
+		}
+		select {
+		case <-time.NewTimer(interval).C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// reset marks all servers as healthy, it's used when health checking gets
+// disabled.
+func (h *healthChecker) reset() {
+	h.lock.Lock()
+	changed := false
+	for _, state := range h.states {
+		if !state.healthy {
+			changed = true
+		}
+		*state = healthState{healthy: true}
+	}
+	h.lock.Unlock()
+	if changed {
+		h.notify()
+	}
+}
+
+func (h *healthChecker) checkAll(config *Config) {
+	h.lock.RLock()
+	servers := make([]*DHCPServer, 0, len(h.servers))
+	for _, server := range h.servers {
+		servers = append(servers, server)
+	}
+	h.lock.RUnlock()
+
+	var wg sync.WaitGroup
+	var changed bool
+	var changedLock sync.Mutex
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server *DHCPServer) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), config.HealthCheck.Timeout)
+			defer cancel()
+			err := h.probe(ctx, config, server)
+			if h.record(server, err, config.HealthCheck) {
+				changedLock.Lock()
+				changed = true
+				changedLock.Unlock()
+			}
+		}(server)
+	}
+	wg.Wait()
+	if changed {
+		h.notify()
+	}
+}
+
+func (h *healthChecker) notify() {
+	select {
+	case h.changed <- struct{}{}:
+	default:
+	}
+}
+
+// isLocalAddr returns true if ip is the address of one of the interfaces of
+// the host.
+func isLocalAddr(ip net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		glog.Errorf("Failed to list the local addresses: %s", err)
+		return false
+	}
+	for _, addr := range addrs {
+		if network, ok := addr.(*net.IPNet); ok && network.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// probeServer sends a synthetic request to server and waits for the outcome
+// according to the configured probe type.
+func probeServer(ctx context.Context, config *Config, server *DHCPServer) error {
+	conn, err := net.DialUDP("udp", nil, server.udpAddr())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	local := conn.LocalAddr().(*net.UDPAddr)
+	relayAddr := config.HealthCheck.RelayAddr
+	if relayAddr == nil {
+		relayAddr = local.IP
+	}
+	var probe []byte
+	if config.Version == 4 {
+		probe, err = newProbeV4(relayAddr, local.Port)
+	} else {
+		probe, err = newProbeV6(relayAddr, local.Port)
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Write(probe); err != nil {
+		return err
+	}
+
+	buffer := make([]byte, config.PacketBufSize)
+	_, err = conn.Read(buffer)
+	if err != nil {
+		var netErr net.Error
+		if config.HealthCheck.Probe == ProbeUDP && errors.As(err, &netErr) && netErr.Timeout() {
+			// no ICMP port unreachable came back, assume the server is up
+			return nil
+		}
+		return fmt.Errorf("no reply from %s: %s", server.Address, err)
+	}
+	return nil
+}
+
+func newProbeV4(relayAddr net.IP, port int) ([]byte, error) {
+	packet, err := dhcpv4.NewInform(
+		net.HardwareAddr{0, 0, 0, 0, 0, 0},
+		relayAddr,
+		dhcpv4.WithRelay(relayAddr),
+		dhcpv4.WithOption(dhcpv4.OptRelayAgentInfo(
+			dhcpv4.OptGeneric(relaySourcePortSubOption, []byte{byte(port >> 8), byte(port)}),
+		)),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return packet.ToBytes(), nil
+}
+
+func newProbeV6(relayAddr net.IP, port int) ([]byte, error) {
+	msg, err := dhcpv6.NewMessage(
+		dhcpv6.WithClientID(&dhcpv6.DUIDLL{
+			HWType:        iana.HWTypeEthernet,
+			LinkLayerAddr: net.HardwareAddr{0, 0, 0, 0, 0, 0},
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	msg.MessageType = dhcpv6.MessageTypeInformationRequest
+	relay, err := dhcpv6.EncapsulateRelay(msg, dhcpv6.MessageTypeRelayForward, relayAddr, relayAddr)
+	if err != nil {
+		return nil, err
+	}
+	relay.AddOption(dhcpv6.OptRelayPort(uint16(port)))
+	return relay.ToBytes(), nil
+}
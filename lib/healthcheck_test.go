@@ -0,0 +1,117 @@
+/**
+ * Copyright (c) Facebook, Inc. and its affiliates.
+ *
+ * This source code is licensed under the MIT license found in the
+ * LICENSE file in the root directory of this source tree.
+ */
+
+package dhcplb
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestHealthCheckRiseFall(t *testing.T) {
+	config := &HealthCheckConfig{Rise: 2, Fall: 3}
+	servers := []*DHCPServer{
+		NewDHCPServer("a", net.ParseIP("10.0.0.1"), 67),
+		NewDHCPServer("b", net.ParseIP("10.0.0.2"), 67),
+	}
+	h := newHealthChecker()
+	h.setServers(servers)
+	failed := errors.New("timeout")
+
+	for i := 0; i < config.Fall-1; i++ {
+		if h.record(servers[0], failed, config) {
+			t.Fatalf("Server shouldn't go down after %d failures", i+1)
+		}
+	}
+	if !h.record(servers[0], failed, config) {
+		t.Fatalf("Server should go down after %d failures", config.Fall)
+	}
+	if h.isHealthy(servers[0]) {
+		t.Fatalf("Server should be unhealthy")
+	}
+	if list := filterServers("stable", servers, h.isHealthy); len(list) != 1 || list[0] != servers[1] {
+		t.Fatalf("Unhealthy server should be filtered out, got %v", list)
+	}
+
+	if h.record(servers[0], nil, config) {
+		t.Fatalf("Server shouldn't come back after a single success")
+	}
+	if !h.record(servers[0], nil, config) {
+		t.Fatalf("Server should come back after %d successes", config.Rise)
+	}
+	if list := filterServers("stable", servers, h.isHealthy); len(list) != 2 {
+		t.Fatalf("Both servers should be healthy, got %v", list)
+	}
+}
+
+func TestHealthCheckAllDown(t *testing.T) {
+	config := &HealthCheckConfig{Rise: 1, Fall: 1}
+	servers := []*DHCPServer{
+		NewDHCPServer("a", net.ParseIP("10.0.0.1"), 67),
+	}
+	h := newHealthChecker()
+	h.setServers(servers)
+	h.record(servers[0], errors.New("timeout"), config)
+	if list := filterServers("stable", servers, h.isHealthy); len(list) != 1 {
+		t.Fatalf("Should fail open when all servers are down, got %v", list)
+	}
+
+	// removed servers are forgotten, and re-added ones start healthy
+	h.setServers(nil)
+	h.setServers(servers)
+	if !h.isHealthy(servers[0]) {
+		t.Fatalf("Re-added server should be healthy")
+	}
+}
+
+func TestHealthCheckRelayAddr(t *testing.T) {
+	for _, tt := range []struct {
+		probe     string
+		relayAddr string
+		valid     bool
+	}{
+		{ProbeDHCP, "127.0.0.1", true},
+		// TEST-NET-1, never assigned to a local interface
+		{ProbeDHCP, "192.0.2.1", false},
+		{ProbeUDP, "192.0.2.1", true},
+	} {
+		spec := &configSpec{HealthCheck: &healthCheckSpec{Probe: tt.probe, RelayAddr: tt.relayAddr}}
+		if _, err := spec.healthCheck(); (err == nil) != tt.valid {
+			t.Fatalf("%s probe with relay_addr %s: expected valid=%v, got %v", tt.probe, tt.relayAddr, tt.valid, err)
+		}
+	}
+}
+
+// rcErrorSourcer is a DHCPServerSourcer failing to load its RC servers.
+type rcErrorSourcer struct {
+	staticSourcer
+}
+
+func (s *rcErrorSourcer) GetRCServers() ([]*DHCPServer, error) {
+	return nil, errors.New("failed to load the RC servers")
+}
+
+func TestHealthStateKeptOnSourcerError(t *testing.T) {
+	stable := NewDHCPServer("stable", net.ParseIP("10.0.0.1"), 67)
+	rc := NewDHCPServer("rc", net.ParseIP("10.0.0.2"), 67)
+	config := newTestConfig(4, []*DHCPServer{stable})
+	config.HostSourcer = &rcErrorSourcer{staticSourcer{stable: []*DHCPServer{stable}}}
+	server := newTestServer(t, config)
+	defer server.conn.Close()
+	server.health.setServers([]*DHCPServer{stable, rc})
+	server.health.record(rc, errors.New("timeout"), &HealthCheckConfig{Rise: 1, Fall: 1})
+
+	// a single pass, the context is already cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	server.updateServersContinuous(ctx)
+	if server.health.isHealthy(rc) {
+		t.Fatalf("The state of the RC server was lost when its list failed to load")
+	}
+}
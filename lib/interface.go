@@ -22,6 +22,11 @@ type DHCPMessage struct {
 	ClientID []byte
 	Mac      net.HardwareAddr
 	Serial   string
+	// giaddr (v4) or link-address (v6) of the relay closest to the client,
+	// or ciaddr of v4 clients which aren't behind a relay, nil if none is
+	// set
+	RelayAddr     net.IP
+	VendorClasses []string
 }
 
 // DHCPBalancingAlgorithm defines an interface for load balancing algorithms.
@@ -46,6 +51,13 @@ type DHCPServerSourcer interface {
 	GetServersFromTier(tier string) ([]*DHCPServer, error)
 }
 
+// DHCPServerSourcerValidator can be implemented by a DHCPServerSourcer to
+// report problems in the server lists which are otherwise only logged, eg
+// malformed lines in host files. It's used when validating a config.
+type DHCPServerSourcerValidator interface {
+	Validate() []error
+}
+
 // Handler is an interface used while serving DHCP requests.
 type Handler interface {
 	ServeDHCPv4(ctx context.Context, packet *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, error)
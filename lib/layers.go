@@ -0,0 +1,157 @@
+/**
+ * Copyright (c) Facebook, Inc. and its affiliates.
+ *
+ * This source code is licensed under the MIT license found in the
+ * LICENSE file in the root directory of this source tree.
+ */
+
+package dhcplb
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// envPrefix prefixes the environment variables setting config fields, eg
+// DHCPLB_V4_RC_RATIO sets rc_ratio in the v4 config.
+const envPrefix = "DHCPLB_"
+
+// ConfigLayer holds config fields set outside of the config file, eg by
+// environment variables or command line flags. Layers are applied on top of
+// the config file, in the order given to SetConfigLayers, every time the
+// config is loaded or reloaded.
+type ConfigLayer struct {
+	// Name is reported by the admin API as the source of the fields set by
+	// the layer
+	Name   string
+	values map[int]map[string]string
+}
+
+// NewConfigLayer returns an empty ConfigLayer.
+func NewConfigLayer(name string) *ConfigLayer {
+	return &ConfigLayer{Name: name, values: make(map[int]map[string]string)}
+}
+
+// NewEnvConfigLayer returns a ConfigLayer holding the fields set by the
+// DHCPLB_V4_<FIELD> and DHCPLB_V6_<FIELD> variables of environ, which is
+// formatted like os.Environ().
+func NewEnvConfigLayer(environ []string) (*ConfigLayer, error) {
+	layer := NewConfigLayer("env")
+	var errs errorList
+	for _, variable := range environ {
+		name, value, _ := strings.Cut(variable, "=")
+		for _, version := range []int{4, 6} {
+			prefix := fmt.Sprintf("%sV%d_", envPrefix, version)
+			if !strings.HasPrefix(name, prefix) {
+				continue
+			}
+			field := strings.ToLower(strings.TrimPrefix(name, prefix))
+			if err := layer.Set(version, field, value); err != nil {
+				errs = errs.add(fmt.Errorf("%s: %s", name, err))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return layer, nil
+}
+
+// Set sets field, given by its name in the config file, in the config of
+// version. value is parsed as JSON, except that strings don't need quotes.
+func (l *ConfigLayer) Set(version int, field, value string) error {
+	if version != 4 && version != 6 {
+		return fmt.Errorf("Invalid version %d", version)
+	}
+	switch field {
+	case "version", "extras":
+		// the version comes from the section of the config file, and extras
+		// are only understood by the ConfigProvider
+		return fmt.Errorf("%s can only be set in the config file", field)
+	}
+	// check the value now, so that mistakes are reported at startup
+	var spec configSpec
+	if err := setSpecField(&spec, field, value); err != nil {
+		return err
+	}
+	if l.values[version] == nil {
+		l.values[version] = make(map[string]string)
+	}
+	l.values[version][field] = value
+	return nil
+}
+
+// configLayers are the layers applied by parseConfig.
+var (
+	configLayersLock sync.Mutex
+	configLayers     []*ConfigLayer
+)
+
+// SetConfigLayers sets the layers applied on top of the config file by
+// LoadConfig, ParseConfig and WatchConfig. Later layers take precedence.
+func SetConfigLayers(layers ...*ConfigLayer) {
+	configLayersLock.Lock()
+	defer configLayersLock.Unlock()
+	configLayers = layers
+}
+
+// applyConfigLayers sets the fields of the config layers in spec, and returns
+// the name of the layer each field comes from.
+func applyConfigLayers(spec *configSpec, version int) (map[string]string, error) {
+	configLayersLock.Lock()
+	defer configLayersLock.Unlock()
+	sources := make(map[string]string)
+	for _, layer := range configLayers {
+		fields := layer.values[version]
+		names := make([]string, 0, len(fields))
+		for field := range fields {
+			names = append(names, field)
+		}
+		sort.Strings(names)
+		for _, field := range names {
+			if err := setSpecField(spec, field, fields[field]); err != nil {
+				return nil, fmt.Errorf("%s: %s", layer.Name, err)
+			}
+			sources[field] = layer.Name
+		}
+	}
+	return sources, nil
+}
+
+// setSpecField decodes value into the field of spec whose json name is field.
+// Sections are merged: the fields of a section which aren't in value keep
+// their current value.
+func setSpecField(spec *configSpec, field, value string) error {
+	v := reflect.ValueOf(spec).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name, _, _ := strings.Cut(v.Type().Field(i).Tag.Get("json"), ",")
+		if name == "" || name != field {
+			continue
+		}
+		target := v.Field(i)
+		raw := []byte(value)
+		if target.Kind() == reflect.String {
+			raw, _ = json.Marshal(value)
+		}
+		// decode into a copy of the current value, the field is left
+		// untouched if value is invalid
+		decoded := reflect.New(target.Type())
+		if target.Kind() == reflect.Ptr && !target.IsNil() {
+			section := reflect.New(target.Type().Elem())
+			section.Elem().Set(target.Elem())
+			decoded.Elem().Set(section)
+		} else {
+			decoded.Elem().Set(target)
+		}
+		if err := json.Unmarshal(raw, decoded.Interface()); err != nil {
+			return fmt.Errorf("Invalid value '%s' for %s: %s", value, field, err)
+		}
+		target.Set(decoded.Elem())
+		return nil
+	}
+	return fmt.Errorf("Unknown config field %s", field)
+}
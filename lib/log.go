@@ -14,7 +14,8 @@ import (
 	"github.com/golang/glog"
 )
 
-// LogMessage holds the info of a log line.
+// LogMessage holds the info of a log line. Packet is a copy owned by the
+// logger, the buffers of the packets are reused once handled.
 type LogMessage struct {
 	Version      int
 	Packet       []byte
@@ -25,6 +26,10 @@ type LogMessage struct {
 	Success      bool
 	ErrorName    string
 	ErrorDetails error
+	// Event is set for the messages reporting something which happened while
+	// handling a packet, eg an override fallback, with ErrorName telling
+	// what. The packet itself is logged separately once handled.
+	Event bool
 }
 
 // PersonalizedLogger is an interface used to log a LogMessage using your own
@@ -33,6 +38,25 @@ type PersonalizedLogger interface {
 	Log(msg LogMessage) error
 }
 
+type multiLogger []PersonalizedLogger
+
+// NewMultiLogger returns a PersonalizedLogger which passes each LogMessage to
+// all the given loggers.
+func NewMultiLogger(loggers ...PersonalizedLogger) PersonalizedLogger {
+	return multiLogger(loggers)
+}
+
+// Log calls all the loggers and returns the first error encountered.
+func (m multiLogger) Log(msg LogMessage) error {
+	var firstErr error
+	for _, logger := range m {
+		if err := logger.Log(msg); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
 // loggerHelper is the implementation of the above interface.
 type loggerHelper struct {
 	personalizedLogger PersonalizedLogger
@@ -49,7 +73,7 @@ func (h *loggerHelper) LogErr(start time.Time, server *DHCPServer, packet []byte
 		}
 		msg := LogMessage{
 			Version:      h.version,
-			Packet:       packet,
+			Packet:       copyPacket(packet),
 			Peer:         peer,
 			Server:       hostname,
 			ServerIsRC:   isRC,
@@ -65,6 +89,33 @@ func (h *loggerHelper) LogErr(start time.Time, server *DHCPServer, packet []byte
 	}
 }
 
+func (h *loggerHelper) LogEvent(start time.Time, server *DHCPServer, packet []byte, peer *net.UDPAddr, eventName string, err error) {
+	if h.personalizedLogger != nil {
+		hostname := ""
+		isRC := false
+		if server != nil {
+			hostname = server.Hostname
+			isRC = server.IsRC
+		}
+		msg := LogMessage{
+			Version:      h.version,
+			Packet:       copyPacket(packet),
+			Peer:         peer,
+			Server:       hostname,
+			ServerIsRC:   isRC,
+			Latency:      time.Since(start),
+			Success:      true,
+			ErrorName:    eventName,
+			ErrorDetails: err,
+			Event:        true,
+		}
+		err := h.personalizedLogger.Log(msg)
+		if err != nil {
+			glog.Errorf("Failed to log event: %s", err)
+		}
+	}
+}
+
 func (h *loggerHelper) LogSuccess(start time.Time, server *DHCPServer, packet []byte, peer *net.UDPAddr) {
 	if h.personalizedLogger != nil {
 		hostname := ""
@@ -75,7 +126,7 @@ func (h *loggerHelper) LogSuccess(start time.Time, server *DHCPServer, packet []
 		}
 		msg := LogMessage{
 			Version:    h.version,
-			Packet:     packet,
+			Packet:     copyPacket(packet),
 			Peer:       peer,
 			Server:     hostname,
 			ServerIsRC: isRC,
@@ -88,3 +139,12 @@ func (h *loggerHelper) LogSuccess(start time.Time, server *DHCPServer, packet []
 		}
 	}
 }
+
+// copyPacket copies a packet whose buffer will be reused, so that loggers can
+// keep it after Log returns.
+func copyPacket(packet []byte) []byte {
+	if packet == nil {
+		return nil
+	}
+	return append([]byte(nil), packet...)
+}
@@ -0,0 +1,39 @@
+/**
+ * Copyright (c) Facebook, Inc. and its affiliates.
+ *
+ * This source code is licensed under the MIT license found in the
+ * LICENSE file in the root directory of this source tree.
+ */
+
+package dhcplb
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// keepingLogger keeps the LogMessages it gets.
+type keepingLogger struct {
+	msgs []LogMessage
+}
+
+func (l *keepingLogger) Log(msg LogMessage) error {
+	l.msgs = append(l.msgs, msg)
+	return nil
+}
+
+func TestLogPacketCopied(t *testing.T) {
+	logger := &keepingLogger{}
+	helper := &loggerHelper{personalizedLogger: logger, version: 4}
+	buffer := []byte{1, 2, 3}
+	helper.LogSuccess(time.Now(), nil, buffer, nil)
+	helper.LogErr(time.Now(), nil, buffer, nil, ErrParse, nil)
+	// the buffer is reused for the next packet
+	copy(buffer, []byte{4, 5, 6})
+	for _, msg := range logger.msgs {
+		if !bytes.Equal(msg.Packet, []byte{1, 2, 3}) {
+			t.Fatalf("Logged packet changed after Log returned: %v", msg.Packet)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+/**
+ * Copyright (c) Facebook, Inc. and its affiliates.
+ *
+ * This source code is licensed under the MIT license found in the
+ * LICENSE file in the root directory of this source tree.
+ */
+
+package dhcplb
+
+import (
+	lru "github.com/hashicorp/golang-lru/v2"
+)
+
+// Hop counts at which packets are dropped when max_hops isn't set in the
+// config: the limit of RFC 1542 in v4, HOP_COUNT_LIMIT of RFC 8415 in v6.
+const (
+	defaultMaxHopsV4 = 16
+	defaultMaxHopsV6 = 8
+)
+
+func defaultMaxHops(version int) int {
+	if version == 6 {
+		return defaultMaxHopsV6
+	}
+	return defaultMaxHopsV4
+}
+
+// loopTableSize is the number of forwarded packets remembered to detect
+// forwarding loops.
+const loopTableSize = 4096
+
+// loopDetector remembers the hop count of the packets recently forwarded, by
+// transaction and client. A packet coming back with the same transaction and
+// at least as many hops already went through dhcplb, eg because a backend
+// relays the requests back to dhcplb instead of serving them, and forwarding
+// it again would loop. Retransmissions from clients come with fewer hops and
+// are forwarded as usual.
+type loopDetector struct {
+	cache *lru.Cache[string, int]
+}
+
+func newLoopDetector(size int) (*loopDetector, error) {
+	cache, err := lru.New[string, int](size)
+	if err != nil {
+		return nil, err
+	}
+	return &loopDetector{cache: cache}, nil
+}
+
+func loopKey(message *DHCPMessage) string {
+	return string(message.XID) + string(message.ClientID)
+}
+
+// forwarded remembers that message was forwarded with hops hops.
+func (l *loopDetector) forwarded(message *DHCPMessage, hops int) {
+	l.cache.Add(loopKey(message), hops)
+}
+
+// looped returns true if message, received with hops hops, was already
+// forwarded by dhcplb.
+func (l *loopDetector) looped(message *DHCPMessage, hops int) bool {
+	forwarded, ok := l.cache.Peek(loopKey(message))
+	return ok && hops >= forwarded
+}
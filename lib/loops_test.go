@@ -0,0 +1,83 @@
+/**
+ * Copyright (c) Facebook, Inc. and its affiliates.
+ *
+ * This source code is licensed under the MIT license found in the
+ * LICENSE file in the root directory of this source tree.
+ */
+
+package dhcplb
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+func TestLoopsV4(t *testing.T) {
+	server, logs, cleanup := newLoggedTestServer(t, 4)
+	defer cleanup()
+	peer := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 67}
+	packet, err := dhcpv4.FromBytes(newTestDiscover(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	send := func(hops uint8) string {
+		packet.HopCount = hops
+		server.handlePacket(context.Background(), packet.ToBytes(), peer)
+		return <-logs
+	}
+
+	if name := send(defaultMaxHopsV4); name != ErrMaxHops {
+		t.Fatalf("Expected %s, got %q", ErrMaxHops, name)
+	}
+	if name := send(1); name != "" {
+		t.Fatalf("Expected the packet to be forwarded, got %s", name)
+	}
+	// retransmitted by the client
+	if name := send(1); name != "" {
+		t.Fatalf("Expected the retransmission to be forwarded, got %s", name)
+	}
+	// forwarded with 2 hops, and relayed back to dhcplb
+	if name := send(2); name != ErrLoop {
+		t.Fatalf("Expected %s, got %q", ErrLoop, name)
+	}
+}
+
+func TestLoopsV6(t *testing.T) {
+	server, logs, cleanup := newLoggedTestServer(t, 6)
+	defer cleanup()
+	peer := &net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 546}
+	solicit, err := dhcpv6.FromBytes(newTestSolicit(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	send := func(packet dhcpv6.DHCPv6) string {
+		server.handlePacket(context.Background(), packet.ToBytes(), peer)
+		return <-logs
+	}
+	relayed := func(hops uint8) dhcpv6.DHCPv6 {
+		relay, err := dhcpv6.EncapsulateRelay(solicit, dhcpv6.MessageTypeRelayForward, net.IPv6zero, peer.IP)
+		if err != nil {
+			t.Fatal(err)
+		}
+		relay.HopCount = hops
+		return relay
+	}
+
+	if name := send(relayed(defaultMaxHopsV6)); name != ErrMaxHops {
+		t.Fatalf("Expected %s, got %q", ErrMaxHops, name)
+	}
+	if name := send(solicit); name != "" {
+		t.Fatalf("Expected the packet to be forwarded, got %s", name)
+	}
+	if name := send(solicit); name != "" {
+		t.Fatalf("Expected the retransmission to be forwarded, got %s", name)
+	}
+	// dhcplb encapsulated the solicit with a hop count of 0
+	if name := send(relayed(0)); name != ErrLoop {
+		t.Fatalf("Expected %s, got %q", ErrLoop, name)
+	}
+}
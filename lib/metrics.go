@@ -0,0 +1,128 @@
+/**
+ * Copyright (c) Facebook, Inc. and its affiliates.
+ *
+ * This source code is licensed under the MIT license found in the
+ * LICENSE file in the root directory of this source tree.
+ */
+
+package dhcplb
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Prometheus collectors, registered in the default registry so that they can
+// be exposed with promhttp.Handler().
+var (
+	packetsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "dhcplb",
+		Name:      "packets_total",
+		Help:      "Packets handled, by outcome.",
+	}, []string{"version", "success"})
+	errorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "dhcplb",
+		Name:      "errors_total",
+		Help:      "Errors by name (E_READ, E_PARSE, E_NO_SERVER, ...).",
+	}, []string{"version", "error"})
+	eventsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "dhcplb",
+		Name:      "events_total",
+		Help:      "Events which didn't prevent handling a packet, by name (E_OVERRIDE_FALLBACK).",
+	}, []string{"version", "event"})
+	forwardedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "dhcplb",
+		Name:      "forwarded_packets_total",
+		Help:      "Packets successfully forwarded to each backend server.",
+	}, []string{"version", "server", "rc"})
+	latencySeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "dhcplb",
+		Name:      "latency_seconds",
+		Help:      "Time spent handling a packet.",
+		Buckets:   prometheus.ExponentialBuckets(0.00001, 4, 10),
+	}, []string{"version", "success"})
+	throttleCacheSize = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "dhcplb",
+		Name:      "throttle_cache_size",
+		Help:      "Number of items in the throttling LRU cache.",
+	}, []string{"version"})
+	queueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "dhcplb",
+		Name:      "queue_depth",
+		Help:      "Packets waiting in the queue of the worker pool.",
+	}, []string{"version"})
+	configReloadsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "dhcplb",
+		Name:      "config_reloads_total",
+		Help:      "Configuration reloads, by outcome.",
+	}, []string{"version", "success"})
+	configReloadFailing = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "dhcplb",
+		Name:      "config_reload_failing",
+		Help:      "1 if the last configuration reload failed and the previous configuration is still in use.",
+	}, []string{"version"})
+	overridesExpiredTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "dhcplb",
+		Name:      "overrides_expired_total",
+		Help:      "Overrides which expired while active.",
+	}, []string{"version"})
+	activeOverridesCount = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "dhcplb",
+		Name:      "active_overrides",
+		Help:      "Overrides from the overrides file currently active.",
+	}, []string{"version"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		packetsTotal,
+		errorsTotal,
+		eventsTotal,
+		forwardedTotal,
+		latencySeconds,
+		throttleCacheSize,
+		queueDepth,
+		configReloadsTotal,
+		configReloadFailing,
+		overridesExpiredTotal,
+		activeOverridesCount,
+	)
+}
+
+type prometheusLogger struct{}
+
+// NewPrometheusLogger returns a PersonalizedLogger which turns LogMessages
+// into Prometheus metrics.
+func NewPrometheusLogger() PersonalizedLogger {
+	return prometheusLogger{}
+}
+
+// Log updates the packet, error, event, forwarding and latency metrics.
+func (l prometheusLogger) Log(msg LogMessage) error {
+	version := strconv.Itoa(msg.Version)
+	if msg.Event {
+		// the packet is counted once handled
+		eventsTotal.WithLabelValues(version, msg.ErrorName).Inc()
+		return nil
+	}
+	success := strconv.FormatBool(msg.Success)
+	packetsTotal.WithLabelValues(version, success).Inc()
+	latencySeconds.WithLabelValues(version, success).Observe(msg.Latency.Seconds())
+	if msg.ErrorName != "" {
+		errorsTotal.WithLabelValues(version, msg.ErrorName).Inc()
+	}
+	if msg.Success && msg.Server != "" {
+		forwardedTotal.WithLabelValues(version, msg.Server, strconv.FormatBool(msg.ServerIsRC)).Inc()
+	}
+	return nil
+}
+
+func recordConfigReload(version int, err error) {
+	configReloadsTotal.WithLabelValues(strconv.Itoa(version), strconv.FormatBool(err == nil)).Inc()
+	failing := 0.0
+	if err != nil {
+		failing = 1
+	}
+	configReloadFailing.WithLabelValues(strconv.Itoa(version)).Set(failing)
+}
@@ -0,0 +1,61 @@
+/**
+ * Copyright (c) Facebook, Inc. and its affiliates.
+ *
+ * This source code is licensed under the MIT license found in the
+ * LICENSE file in the root directory of this source tree.
+ */
+
+package dhcplb
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestPrometheusLogger(t *testing.T) {
+	logger := NewPrometheusLogger()
+	forwarded := forwardedTotal.WithLabelValues("4", "dhcp1", "false")
+	noServer := errorsTotal.WithLabelValues("4", ErrNoServer)
+	fallback := eventsTotal.WithLabelValues("4", ErrFallback)
+	packets := packetsTotal.WithLabelValues("4", "true")
+	before := testutil.ToFloat64(forwarded)
+	beforeErr := testutil.ToFloat64(noServer)
+	beforeEvent := testutil.ToFloat64(fallback)
+	beforePackets := testutil.ToFloat64(packets)
+
+	logger.Log(LogMessage{
+		Version: 4,
+		Server:  "dhcp1",
+		Latency: time.Millisecond,
+		Success: true,
+	})
+	logger.Log(LogMessage{
+		Version:      4,
+		Success:      false,
+		ErrorName:    ErrNoServer,
+		ErrorDetails: errors.New("Server list is empty"),
+	})
+	logger.Log(LogMessage{
+		Version:      4,
+		Success:      true,
+		ErrorName:    ErrFallback,
+		ErrorDetails: errors.New("Tier is unavailable"),
+		Event:        true,
+	})
+
+	if got := testutil.ToFloat64(forwarded) - before; got != 1 {
+		t.Errorf("Expected 1 forwarded packet, got %v", got)
+	}
+	if got := testutil.ToFloat64(noServer) - beforeErr; got != 1 {
+		t.Errorf("Expected 1 %s error, got %v", ErrNoServer, got)
+	}
+	if got := testutil.ToFloat64(fallback) - beforeEvent; got != 1 {
+		t.Errorf("Expected 1 %s event, got %v", ErrFallback, got)
+	}
+	if got := testutil.ToFloat64(packets) - beforePackets; got != 1 {
+		t.Errorf("Events shouldn't be counted as packets, got %v successful packets", got)
+	}
+}
@@ -42,7 +42,8 @@ func (m *modulo) SelectServerFromList(list []*DHCPServer, message *DHCPMessage)
 	if len(list) == 0 {
 		return nil, errors.New("Server list is empty")
 	}
-	return list[hash%uint32(len(list))], nil
+	// with all weights set to 1 this is equivalent to hash % len(list)
+	return selectWeighted(list, int(hash%uint32(totalWeight(list)))), nil
 }
 
 func (m *modulo) SelectRatioBasedDhcpServer(message *DHCPMessage) (*DHCPServer, error) {
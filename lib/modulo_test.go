@@ -52,3 +52,26 @@ func Test_Hash(t *testing.T) {
 		}
 	}
 }
+
+func Test_Weighted(t *testing.T) {
+	subject := new(modulo)
+	servers := []*DHCPServer{
+		{Port: 0, Weight: 3},
+		{Port: 1},
+	}
+	subject.UpdateStableServerList(servers)
+	counts := make(map[int]int)
+	for i := 0; i < 4000; i++ {
+		server, err := subject.SelectRatioBasedDhcpServer(&DHCPMessage{
+			ClientID: []byte{byte(i >> 8), byte(i), 0x42},
+		})
+		if err != nil {
+			t.Fatalf("Unexpected error selecting server: %s", err)
+		}
+		counts[server.Port]++
+	}
+	// expect roughly a 3:1 split
+	if counts[0] < 2*counts[1] || counts[0] > 4*counts[1] {
+		t.Fatalf("Weights not honored: %v", counts)
+	}
+}
@@ -0,0 +1,303 @@
+/**
+ * Copyright (c) Facebook, Inc. and its affiliates.
+ *
+ * This source code is licensed under the MIT license found in the
+ * LICENSE file in the root directory of this source tree.
+ */
+
+package dhcplb
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Prefixes of the keys in the overrides file. Keys without a prefix are MAC
+// addresses.
+const (
+	overrideDUID        = "duid:"
+	overrideSerial      = "serial:"
+	overrideVendorClass = "vendor_class:"
+	overrideSubnet      = "subnet:"
+)
+
+// subnetOverride is an override matching the clients behind a relay whose
+// giaddr (v4) or link-address (v6) belongs to subnet.
+type subnetOverride struct {
+	key    string
+	subnet *net.IPNet
+}
+
+// overrideIndex holds the overrides of a version indexed by the kind of key
+// they match. When several overrides match a message the most specific one
+// is used, in this order: MAC, DUID, vendor serial, vendor class and relay
+// subnet, the longest prefix winning among subnets.
+type overrideIndex struct {
+	mac         map[string]string
+	duid        map[string]string
+	serial      map[string]string
+	vendorClass map[string]string
+	subnets     []subnetOverride
+}
+
+// newOverrideIndex validates the keys of overrides and indexes them.
+func newOverrideIndex(overrides map[string]Override) (*overrideIndex, error) {
+	index := &overrideIndex{
+		mac:         make(map[string]string),
+		duid:        make(map[string]string),
+		serial:      make(map[string]string),
+		vendorClass: make(map[string]string),
+	}
+	var errs errorList
+	for _, key := range sortedKeys(overrides) {
+		switch {
+		case strings.HasPrefix(key, overrideDUID):
+			duid, err := parseDUID(strings.TrimPrefix(key, overrideDUID))
+			if err != nil {
+				errs = errs.add(fmt.Errorf("Invalid override key %s: %s", key, err))
+				continue
+			}
+			index.duid[duid] = key
+		case strings.HasPrefix(key, overrideSerial):
+			index.serial[strings.TrimPrefix(key, overrideSerial)] = key
+		case strings.HasPrefix(key, overrideVendorClass):
+			index.vendorClass[strings.TrimPrefix(key, overrideVendorClass)] = key
+		case strings.HasPrefix(key, overrideSubnet):
+			_, subnet, err := net.ParseCIDR(strings.TrimPrefix(key, overrideSubnet))
+			if err != nil {
+				errs = errs.add(fmt.Errorf("Invalid override key %s: %s", key, err))
+				continue
+			}
+			index.subnets = append(index.subnets, subnetOverride{key, subnet})
+		default:
+			mac, err := net.ParseMAC(key)
+			if err != nil {
+				// keys which never matched anything used to load fine,
+				// don't fail files which have some, ValidateConfig reports
+				// them
+				glog.Warningf("Ignoring override %s, it's neither a MAC address nor a supported prefix", key)
+				continue
+			}
+			index.mac[mac.String()] = key
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	// longest prefixes first, so that the first match is the most specific
+	sort.Slice(index.subnets, func(i, j int) bool {
+		ones, _ := index.subnets[i].subnet.Mask.Size()
+		otherOnes, _ := index.subnets[j].subnet.Mask.Size()
+		if ones != otherOnes {
+			return ones > otherOnes
+		}
+		return index.subnets[i].key < index.subnets[j].key
+	})
+	return index, nil
+}
+
+// unknownOverrideKeys returns an error for each key of overrides which is
+// neither a MAC address nor prefixed by a supported prefix.
+func unknownOverrideKeys(overrides map[string]Override) []error {
+	var errs []error
+	for _, key := range sortedKeys(overrides) {
+		prefixed := false
+		for _, prefix := range []string{overrideDUID, overrideSerial, overrideVendorClass, overrideSubnet} {
+			prefixed = prefixed || strings.HasPrefix(key, prefix)
+		}
+		if _, err := net.ParseMAC(key); err != nil && !prefixed {
+			errs = append(errs, fmt.Errorf("Invalid override key %s: it's neither a MAC address nor a supported prefix", key))
+		}
+	}
+	return errs
+}
+
+func sortedKeys(overrides map[string]Override) []string {
+	keys := make([]string, 0, len(overrides))
+	for key := range overrides {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// parseDUID accepts a DUID in hex, optionally separated by colons or dashes,
+// and returns it in lowercase hex without separators.
+func parseDUID(s string) (string, error) {
+	s = strings.NewReplacer(":", "", "-", "").Replace(s)
+	duid, err := hex.DecodeString(s)
+	if err != nil {
+		return "", err
+	}
+	if len(duid) == 0 {
+		return "", fmt.Errorf("empty DUID")
+	}
+	return hex.EncodeToString(duid), nil
+}
+
+// candidates returns the keys of the overrides matching message, from the
+// most specific to the least specific one.
+func (i *overrideIndex) candidates(version int, message *DHCPMessage) []string {
+	if i == nil {
+		return nil
+	}
+	var keys []string
+	if key, ok := i.mac[message.Mac.String()]; ok {
+		keys = append(keys, key)
+	}
+	// in v4 the client ID is the hardware address, not a DUID
+	if version == 6 && len(message.ClientID) > 0 {
+		if key, ok := i.duid[hex.EncodeToString(message.ClientID)]; ok {
+			keys = append(keys, key)
+		}
+	}
+	if message.Serial != "" {
+		if key, ok := i.serial[message.Serial]; ok {
+			keys = append(keys, key)
+		}
+	}
+	for _, class := range message.VendorClasses {
+		if key, ok := i.vendorClass[class]; ok {
+			keys = append(keys, key)
+			break
+		}
+	}
+	if message.RelayAddr != nil {
+		for _, subnet := range i.subnets {
+			if subnet.subnet.Contains(message.RelayAddr) {
+				keys = append(keys, subnet.key)
+			}
+		}
+	}
+	return keys
+}
+
+// overrideSweepInterval is how often overrides are checked for ones that
+// started or expired.
+const overrideSweepInterval = time.Second
+
+// overrideSchedule holds the index of the overrides which are currently
+// active. Start and expiration times are evaluated by a background sweep, so
+// that packets are only matched against the index.
+type overrideSchedule struct {
+	version   int
+	overrides map[string]Override
+	lock      sync.RWMutex
+	index     *overrideIndex
+	active    map[string]bool
+	// next is the earliest start or expiration time after the last sweep
+	next time.Time
+}
+
+// newOverrideSchedule validates the keys of all the overrides, and indexes
+// the ones which are active at now.
+func newOverrideSchedule(overrides map[string]Override, version int, now time.Time) (*overrideSchedule, error) {
+	if _, err := newOverrideIndex(overrides); err != nil {
+		return nil, err
+	}
+	s := &overrideSchedule{version: version, overrides: overrides}
+	for key, override := range overrides {
+		if !override.expirationTime.IsZero() && !now.Before(override.expirationTime) {
+			glog.Warningf("Override rule %s expired on %s, ignoring", key, override.expirationTime.Local())
+		}
+	}
+	s.sweep(now)
+	return s, nil
+}
+
+// sweep rebuilds the index if an override started or expired since the last
+// sweep.
+func (s *overrideSchedule) sweep(now time.Time) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.index != nil && (s.next.IsZero() || now.Before(s.next)) {
+		return
+	}
+	version := strconv.Itoa(s.version)
+	active := make(map[string]Override)
+	s.next = time.Time{}
+	for key, override := range s.overrides {
+		if !override.startTime.IsZero() && now.Before(override.startTime) {
+			s.scheduleAt(override.startTime)
+			continue
+		}
+		if !override.expirationTime.IsZero() && !now.Before(override.expirationTime) {
+			if s.active[key] {
+				glog.Infof("Override rule %s expired on %s", key, override.expirationTime.Local())
+				overridesExpiredTotal.WithLabelValues(version).Inc()
+			}
+			continue
+		}
+		if s.index != nil && !s.active[key] {
+			glog.Infof("Override rule %s started on %s", key, override.startTime.Local())
+		}
+		if !override.expirationTime.IsZero() {
+			s.scheduleAt(override.expirationTime)
+		}
+		active[key] = override
+	}
+	// keys were validated by newOverrideSchedule
+	s.index, _ = newOverrideIndex(active)
+	s.active = make(map[string]bool, len(active))
+	for key := range active {
+		s.active[key] = true
+	}
+	activeOverridesCount.WithLabelValues(version).Set(float64(len(active)))
+}
+
+func (s *overrideSchedule) scheduleAt(t time.Time) {
+	if s.next.IsZero() || t.Before(s.next) {
+		s.next = t
+	}
+}
+
+// candidates returns the keys of the active overrides matching message, from
+// the most specific to the least specific one.
+func (s *overrideSchedule) candidates(message *DHCPMessage) []string {
+	if s == nil {
+		return nil
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.index.candidates(s.version, message)
+}
+
+// isActive tells whether the override with the given key is currently
+// active.
+func (s *overrideSchedule) isActive(key string) bool {
+	if s == nil {
+		return false
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.active[key]
+}
+
+// sweepOverrides activates scheduled overrides and retires expired ones until
+// ctx is cancelled.
+func (s *Server) sweepOverrides(ctx context.Context) {
+	ticker := time.NewTicker(overrideSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		now := time.Now()
+		s.GetConfig().activeOverrides.sweep(now)
+		s.sweepOverrideServers(now)
+	}
+}
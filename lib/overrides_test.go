@@ -0,0 +1,248 @@
+/**
+ * Copyright (c) Facebook, Inc. and its affiliates.
+ *
+ * This source code is licensed under the MIT license found in the
+ * LICENSE file in the root directory of this source tree.
+ */
+
+package dhcplb
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestOverrideIndexInvalidKeys(t *testing.T) {
+	for _, key := range []string{
+		"duid:xyz",
+		"duid:",
+		"subnet:10.0.0.0",
+		"subnet:10.0.0.0/33",
+	} {
+		if _, err := newOverrideIndex(map[string]Override{key: {Tier: "t"}}); err == nil {
+			t.Fatalf("Expected an error for key %s", key)
+		}
+	}
+}
+
+func TestOverrideIndexUnknownKeys(t *testing.T) {
+	index, err := newOverrideIndex(map[string]Override{
+		"not-a-mac":         {Tier: "t"},
+		"aa:bb:cc:dd:ee:ff": {Tier: "t"},
+	})
+	if err != nil {
+		t.Fatalf("Unknown keys should be skipped: %s", err)
+	}
+	if len(index.mac) != 1 {
+		t.Fatalf("Expected only the MAC override to be indexed, got %v", index.mac)
+	}
+}
+
+// newTestOverridesConfig returns a config with the given overrides, as if
+// they were loaded from the overrides file.
+func newTestOverridesConfig(t *testing.T, version int, overrides map[string]Override) *Config {
+	for key, override := range overrides {
+		if err := override.parse(); err != nil {
+			t.Fatalf("Invalid override %s: %s", key, err)
+		}
+		overrides[key] = override
+	}
+	schedule, err := newOverrideSchedule(overrides, version, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Config{Version: version, Overrides: overrides, activeOverrides: schedule}
+}
+
+func TestOverridePrecedence(t *testing.T) {
+	overrides := map[string]Override{
+		"AA:BB:CC:DD:EE:FF":          {Host: "10.0.0.1"},
+		"duid:00:01:00:01:aa:bb":     {Host: "10.0.0.2"},
+		"serial:ABC123":              {Host: "10.0.0.3"},
+		"vendor_class:PXEClient":     {Host: "10.0.0.4"},
+		"subnet:10.1.0.0/16":         {Host: "10.0.0.5"},
+		"subnet:10.1.2.0/24":         {Host: "10.0.0.6"},
+		"subnet:fd00::/64":           {Host: "10.0.0.7"},
+		"duid:ffff":                  {Host: "10.0.0.8", Expiration: "2017/05/06 14:00 +0000"},
+		"vendor_class:expired-class": {Host: "10.0.0.9", Expiration: "2017/05/06 14:00 +0000"},
+	}
+	config := newTestOverridesConfig(t, 6, overrides)
+	mac := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+	other := net.HardwareAddr{0, 0, 0, 0, 0, 1}
+
+	for _, tt := range []struct {
+		name    string
+		message DHCPMessage
+		host    string
+	}{
+		{"mac", DHCPMessage{Mac: mac, ClientID: []byte{0, 1, 0, 1, 0xaa, 0xbb}, Serial: "ABC123"}, "10.0.0.1"},
+		{"duid", DHCPMessage{Mac: other, ClientID: []byte{0, 1, 0, 1, 0xaa, 0xbb}, Serial: "ABC123"}, "10.0.0.2"},
+		{"serial", DHCPMessage{Mac: other, Serial: "ABC123", VendorClasses: []string{"PXEClient"}}, "10.0.0.3"},
+		{"vendor class", DHCPMessage{Mac: other, VendorClasses: []string{"other", "PXEClient"}, RelayAddr: net.ParseIP("10.1.2.3")}, "10.0.0.4"},
+		{"longest subnet", DHCPMessage{Mac: other, RelayAddr: net.ParseIP("10.1.2.3")}, "10.0.0.6"},
+		{"shorter subnet", DHCPMessage{Mac: other, RelayAddr: net.ParseIP("10.1.3.3")}, "10.0.0.5"},
+		{"v6 subnet", DHCPMessage{Mac: other, RelayAddr: net.ParseIP("fd00::1")}, "10.0.0.7"},
+		{"expired", DHCPMessage{Mac: other, ClientID: []byte{0xff, 0xff}, VendorClasses: []string{"expired-class"}}, ""},
+	} {
+		override, ok := findOverride(config, &tt.message)
+		if ok != (tt.host != "") || override.Host != tt.host {
+			t.Fatalf("%s: expected host %q, got %q", tt.name, tt.host, override.Host)
+		}
+	}
+
+	// DUIDs are only matched in v6
+	config = newTestOverridesConfig(t, 4, overrides)
+	if _, ok := findOverride(config, &DHCPMessage{Mac: other, ClientID: []byte{0, 1, 0, 1, 0xaa, 0xbb}}); ok {
+		t.Fatalf("DUID override matched in v4")
+	}
+}
+
+func TestParseOverrides(t *testing.T) {
+	overrides, err := parseOverrides([]byte(`{"v4": {
+		"aa:bb:cc:dd:ee:ff": {"host": "10.0.0.1", "expiration": "2017/05/06 14:00 +0000"},
+		"serial:ABC123": {"tier": "test", "start": "2030-01-01T00:00:00Z", "expiration": "2030-01-02T00:00:00+02:00"}
+	}}`), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := overrides["aa:bb:cc:dd:ee:ff"]
+	if !legacy.expirationTime.Equal(time.Date(2017, 5, 6, 14, 0, 0, 0, time.UTC)) {
+		t.Fatalf("Unexpected expiration %s", legacy.expirationTime)
+	}
+	scheduled := overrides["serial:ABC123"]
+	if !scheduled.startTime.Equal(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)) ||
+		!scheduled.expirationTime.Equal(time.Date(2030, 1, 1, 22, 0, 0, 0, time.UTC)) {
+		t.Fatalf("Unexpected start %s or expiration %s", scheduled.startTime, scheduled.expirationTime)
+	}
+
+	for _, override := range []string{
+		`{"host": "10.0.0.1", "expiration": "tomorrow"}`,
+		`{"host": "10.0.0.1", "start": "2030/01/01"}`,
+		`{"host": "10.0.0.1", "start": "2030-01-02T00:00:00Z", "expiration": "2030-01-01T00:00:00Z"}`,
+		`{"host": "not-an-ip"}`,
+		`{}`,
+	} {
+		file := []byte(`{"v4": {"aa:bb:cc:dd:ee:ff": ` + override + `}}`)
+		if _, err := parseOverrides(file, 4); err == nil {
+			t.Fatalf("Expected an error for %s", override)
+		}
+	}
+}
+
+func TestOverrideSchedule(t *testing.T) {
+	now := time.Now()
+	overrides := map[string]Override{
+		"aa:bb:cc:dd:ee:ff": {
+			Host:           "10.0.0.1",
+			startTime:      now.Add(time.Hour),
+			expirationTime: now.Add(2 * time.Hour),
+		},
+	}
+	schedule, err := newOverrideSchedule(overrides, 4, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := &DHCPMessage{Mac: net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}}
+	for _, tt := range []struct {
+		at     time.Time
+		active bool
+	}{
+		{now, false},
+		{now.Add(time.Hour), true},
+		{now.Add(90 * time.Minute), true},
+		{now.Add(2 * time.Hour), false},
+	} {
+		schedule.sweep(tt.at)
+		if active := len(schedule.candidates(message)) > 0; active != tt.active {
+			t.Fatalf("Expected active=%v at %s, got %v", tt.active, tt.at.Sub(now), active)
+		}
+		if schedule.isActive("aa:bb:cc:dd:ee:ff") != tt.active {
+			t.Fatalf("isActive doesn't match the index at %s", tt.at.Sub(now))
+		}
+	}
+}
+
+// tierSourcer is a DHCPServerSourcer returning the servers of named tiers.
+type tierSourcer map[string][]*DHCPServer
+
+func (s tierSourcer) GetStableServers() ([]*DHCPServer, error) {
+	return nil, nil
+}
+
+func (s tierSourcer) GetRCServers() ([]*DHCPServer, error) {
+	return nil, nil
+}
+
+func (s tierSourcer) GetServersFromTier(tier string) ([]*DHCPServer, error) {
+	servers, ok := s[tier]
+	if !ok {
+		return nil, fmt.Errorf("unknown tier %s", tier)
+	}
+	return servers, nil
+}
+
+func TestOverrideFallback(t *testing.T) {
+	stable := NewDHCPServer("stable", net.ParseIP("10.0.0.1"), 67)
+	alternate := NewDHCPServer("alternate", net.ParseIP("10.0.0.2"), 67)
+	down := NewDHCPServer("down", net.ParseIP("10.0.0.3"), 67)
+	config := newTestConfig(4, []*DHCPServer{stable})
+	config.HostSourcer = tierSourcer{"alternate": {alternate}, "down": {down}}
+	overrides := newTestOverridesConfig(t, 4, map[string]Override{
+		"00:00:00:00:00:01": {Tier: "missing"},
+		"00:00:00:00:00:02": {Tier: "missing", Fallback: FallbackDrop},
+		"00:00:00:00:00:03": {Tier: "missing", Fallback: FallbackDefault},
+		"00:00:00:00:00:04": {Tier: "missing", Fallback: "tier:alternate"},
+		"00:00:00:00:00:05": {Tier: "down", Fallback: "tier:alternate"},
+		"00:00:00:00:00:06": {Host: "10.0.0.3", Fallback: FallbackDefault},
+		"00:00:00:00:00:07": {Tier: "down"},
+	})
+	config.Overrides = overrides.Overrides
+	config.activeOverrides = overrides.activeOverrides
+	server := newTestServer(t, config)
+	defer server.conn.Close()
+	server.health.setServers([]*DHCPServer{down})
+	server.health.record(down, fmt.Errorf("timeout"), &HealthCheckConfig{Rise: 1, Fall: 1})
+	logs := &keepingLogger{}
+	server.logger.personalizedLogger = logs
+
+	for _, tt := range []struct {
+		mac      byte
+		expected *DHCPServer
+	}{
+		{1, nil},
+		{2, nil},
+		{3, stable},
+		{4, alternate},
+		{5, alternate},
+		{6, stable},
+		// without a fallback the health of the tier is ignored
+		{7, down},
+	} {
+		mac := net.HardwareAddr{0, 0, 0, 0, 0, tt.mac}
+		message := &DHCPMessage{XID: []byte{1, 2, 3, 4}, Mac: mac, ClientID: mac}
+		selected, err := server.selectDestinationServer(time.Now(), config, message)
+		if tt.expected == nil {
+			if err == nil {
+				t.Fatalf("%s: expected the packet to be dropped, got %s", mac, selected.Hostname)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: unexpected error %s", mac, err)
+		}
+		if selected.Address.String() != tt.expected.Address.String() {
+			t.Fatalf("%s: expected %s, got %s", mac, tt.expected.Hostname, selected.Hostname)
+		}
+	}
+	// the packets are still forwarded, fallbacks aren't failures
+	if len(logs.msgs) != 4 {
+		t.Fatalf("Expected 4 fallbacks to be logged, got %d", len(logs.msgs))
+	}
+	for _, msg := range logs.msgs {
+		if !msg.Event || !msg.Success || msg.ErrorName != ErrFallback {
+			t.Fatalf("Fallback should be logged as an event, got %+v", msg)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+/**
+ * Copyright (c) Facebook, Inc. and its affiliates.
+ *
+ * This source code is licensed under the MIT license found in the
+ * LICENSE file in the root directory of this source tree.
+ */
+
+package dhcplb
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// Policies applied to the v4 packets which already carry a relay agent
+// information option (option 82) when dhcplb is configured to add one.
+const (
+	// RelayInfoKeep forwards the packet with its option 82 unchanged, this is
+	// the default.
+	RelayInfoKeep = "keep"
+	// RelayInfoReplace replaces the option 82 of the packet with the one
+	// configured. It requires Config.RewriteGiaddr, so that the replies go
+	// back to the relay agent with its own option 82 rather than with the
+	// one of dhcplb.
+	RelayInfoReplace = "replace"
+	// RelayInfoDrop drops the packet.
+	RelayInfoDrop = "drop"
+)
+
+// RelayAgentInfoConfig holds the sub-options of the relay agent information
+// option (option 82, RFC 3046) added to the v4 packets relayed to the
+// backends. Sub-options which are nil aren't added.
+type RelayAgentInfoConfig struct {
+	// Policy is applied to packets which already carry option 82
+	Policy    string
+	CircuitID []byte
+	RemoteID  []byte
+	// LinkSelection is the subnet the backend should allocate from, instead
+	// of the one of giaddr (RFC 3527)
+	LinkSelection net.IP
+	// ServerIDOverride is the address clients should send their renewals to,
+	// instead of the server identifier of the backend (RFC 5107)
+	ServerIDOverride net.IP
+	// StripReplies removes option 82 from the replies dhcplb sends straight
+	// to clients, replies to downstream relays keep it
+	StripReplies bool
+}
+
+// relayAgentInfoSpec holds the raw json configuration of option 82.
+type relayAgentInfoSpec struct {
+	Policy           string `json:"policy"`
+	CircuitID        string `json:"circuit_id"`
+	RemoteID         string `json:"remote_id"`
+	LinkSelection    string `json:"link_selection"`
+	ServerIDOverride string `json:"server_id_override"`
+	StripReplies     bool   `json:"strip_replies"`
+}
+
+func (c *configSpec) relayAgentInfo() (*RelayAgentInfoConfig, error) {
+	if c.RelayAgentInfo == nil {
+		return nil, nil
+	}
+	if c.Version != 4 {
+		return nil, fmt.Errorf("relay_agent_info is only supported in v4")
+	}
+	spec := c.RelayAgentInfo
+	rai := &RelayAgentInfoConfig{
+		Policy:       spec.Policy,
+		StripReplies: spec.StripReplies,
+	}
+	if rai.Policy == "" {
+		rai.Policy = RelayInfoKeep
+	}
+	if rai.Policy != RelayInfoKeep && rai.Policy != RelayInfoReplace && rai.Policy != RelayInfoDrop {
+		return nil, fmt.Errorf(
+			"'%s' is not a supported relay_agent_info policy, supported policies are: %s, %s, %s",
+			rai.Policy, RelayInfoKeep, RelayInfoReplace, RelayInfoDrop)
+	}
+	if rai.Policy == RelayInfoReplace && c.Giaddr == "" {
+		// without it the backends reply straight to the relay agents, which
+		// would get sub-options they don't know about
+		return nil, fmt.Errorf("relay_agent_info policy %s requires giaddr", RelayInfoReplace)
+	}
+	for _, id := range []struct {
+		name  string
+		value string
+		dest  *[]byte
+	}{
+		{"circuit_id", spec.CircuitID, &rai.CircuitID},
+		{"remote_id", spec.RemoteID, &rai.RemoteID},
+	} {
+		if len(id.value) > 255 {
+			return nil, fmt.Errorf("relay_agent_info %s is longer than 255 bytes", id.name)
+		}
+		if id.value != "" {
+			*id.dest = []byte(id.value)
+		}
+	}
+	for _, addr := range []struct {
+		name  string
+		value string
+		dest  *net.IP
+	}{
+		{"link_selection", spec.LinkSelection, &rai.LinkSelection},
+		{"server_id_override", spec.ServerIDOverride, &rai.ServerIDOverride},
+	} {
+		if addr.value == "" {
+			continue
+		}
+		if *addr.dest = net.ParseIP(addr.value).To4(); *addr.dest == nil {
+			return nil, fmt.Errorf("Unable to parse relay_agent_info %s %s", addr.name, addr.value)
+		}
+	}
+	return rai, nil
+}
+
+// subOptions returns the configured sub-options.
+func (c *RelayAgentInfoConfig) subOptions() []dhcpv4.Option {
+	var options []dhcpv4.Option
+	if c.CircuitID != nil {
+		options = append(options, dhcpv4.OptGeneric(dhcpv4.AgentCircuitIDSubOption, c.CircuitID))
+	}
+	if c.RemoteID != nil {
+		options = append(options, dhcpv4.OptGeneric(dhcpv4.AgentRemoteIDSubOption, c.RemoteID))
+	}
+	if c.LinkSelection != nil {
+		options = append(options, dhcpv4.OptGeneric(dhcpv4.LinkSelectionSubOption, c.LinkSelection))
+	}
+	if c.ServerIDOverride != nil {
+		options = append(options, dhcpv4.OptGeneric(dhcpv4.ServerIdentifierOverrideSubOption, c.ServerIDOverride))
+	}
+	return options
+}
+
+// insert adds option 82 to a packet relayed to a backend, applying the policy
+// if the packet already carries one. An error means that the packet must be
+// dropped.
+func (c *RelayAgentInfoConfig) insert(packet *dhcpv4.DHCPv4) error {
+	if packet.Options.Has(dhcpv4.OptionRelayAgentInformation) {
+		switch c.Policy {
+		case RelayInfoKeep:
+			return nil
+		case RelayInfoDrop:
+			return fmt.Errorf("Packet already carries a relay agent information option")
+		}
+		packet.DeleteOption(dhcpv4.OptionRelayAgentInformation)
+	}
+	// RFC 3046 doesn't allow an option 82 without sub-options
+	if options := c.subOptions(); len(options) > 0 {
+		packet.UpdateOption(dhcpv4.OptRelayAgentInfo(options...))
+	}
+	return nil
+}
+
+// strip removes option 82 from a reply sent straight to a client, if
+// configured.
+func (c *RelayAgentInfoConfig) strip(reply *dhcpv4.DHCPv4) {
+	if c.StripReplies {
+		reply.DeleteOption(dhcpv4.OptionRelayAgentInformation)
+	}
+}
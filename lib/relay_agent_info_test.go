@@ -0,0 +1,115 @@
+/**
+ * Copyright (c) Facebook, Inc. and its affiliates.
+ *
+ * This source code is licensed under the MIT license found in the
+ * LICENSE file in the root directory of this source tree.
+ */
+
+package dhcplb
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+func TestRelayAgentInfoSpec(t *testing.T) {
+	for _, spec := range []*relayAgentInfoSpec{
+		{Policy: "append"},
+		{LinkSelection: "not-an-ip"},
+		{ServerIDOverride: "fd00::1"},
+		{CircuitID: string(make([]byte, 256))},
+		// the relay agents would get the option 82 of dhcplb back
+		{Policy: RelayInfoReplace},
+	} {
+		c := &configSpec{Version: 4, RelayAgentInfo: spec}
+		if _, err := c.relayAgentInfo(); err == nil {
+			t.Fatalf("Expected an error for %+v", spec)
+		}
+	}
+	c := &configSpec{Version: 6, RelayAgentInfo: &relayAgentInfoSpec{}}
+	if _, err := c.relayAgentInfo(); err == nil {
+		t.Fatalf("Expected an error for v6")
+	}
+	c = &configSpec{Version: 4, RelayAgentInfo: &relayAgentInfoSpec{CircuitID: "dhcplb"}}
+	rai, err := c.relayAgentInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rai.Policy != RelayInfoKeep || rai.RemoteID != nil {
+		t.Fatalf("Unexpected defaults %+v", rai)
+	}
+	c = &configSpec{Version: 4, Giaddr: "10.0.0.5", RelayAgentInfo: &relayAgentInfoSpec{Policy: RelayInfoReplace}}
+	if _, err := c.relayAgentInfo(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRelayAgentInfoInsert(t *testing.T) {
+	rai := &RelayAgentInfoConfig{
+		CircuitID:        []byte("circuit"),
+		RemoteID:         []byte("remote"),
+		LinkSelection:    net.ParseIP("10.1.0.0").To4(),
+		ServerIDOverride: net.ParseIP("10.0.0.1").To4(),
+		StripReplies:     true,
+	}
+	existing := dhcpv4.OptRelayAgentInfo(dhcpv4.OptGeneric(dhcpv4.AgentCircuitIDSubOption, []byte("downstream")))
+
+	for _, tt := range []struct {
+		policy   string
+		existing bool
+		dropped  bool
+		circuit  string
+	}{
+		{RelayInfoKeep, false, false, "circuit"},
+		{RelayInfoKeep, true, false, "downstream"},
+		{RelayInfoReplace, true, false, "circuit"},
+		{RelayInfoDrop, false, false, "circuit"},
+		{RelayInfoDrop, true, true, ""},
+	} {
+		packet, err := dhcpv4.NewDiscovery(net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.existing {
+			packet.UpdateOption(existing)
+		}
+		rai.Policy = tt.policy
+		err = rai.insert(packet)
+		if tt.dropped {
+			if err == nil {
+				t.Fatalf("%s: expected the packet to be dropped", tt.policy)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: unexpected error %s", tt.policy, err)
+		}
+		// check what the backend would get
+		parsed, err := dhcpv4.FromBytes(packet.ToBytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		info := parsed.RelayAgentInfo()
+		if info == nil {
+			t.Fatalf("%s: missing option 82", tt.policy)
+		}
+		if circuit := info.Get(dhcpv4.AgentCircuitIDSubOption); string(circuit) != tt.circuit {
+			t.Fatalf("%s: expected circuit id %q, got %q", tt.policy, tt.circuit, circuit)
+		}
+		if tt.circuit == "circuit" {
+			if !bytes.Equal(info.Get(dhcpv4.LinkSelectionSubOption), []byte{10, 1, 0, 0}) ||
+				!bytes.Equal(info.Get(dhcpv4.ServerIdentifierOverrideSubOption), []byte{10, 0, 0, 1}) ||
+				string(info.Get(dhcpv4.AgentRemoteIDSubOption)) != "remote" {
+				t.Fatalf("%s: unexpected sub-options %s", tt.policy, info)
+			}
+		}
+
+		rai.strip(parsed)
+		if parsed.RelayAgentInfo() != nil {
+			t.Fatalf("%s: option 82 wasn't stripped", tt.policy)
+		}
+	}
+}
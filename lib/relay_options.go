@@ -0,0 +1,153 @@
+/**
+ * Copyright (c) Facebook, Inc. and its affiliates.
+ *
+ * This source code is licensed under the MIT license found in the
+ * LICENSE file in the root directory of this source tree.
+ */
+
+package dhcplb
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+// LinkAddrRelay makes dhcplb use the link-address set by the relay closest to
+// the client as the link-address of its Relay-Forward messages.
+const LinkAddrRelay = "relay"
+
+// RelayOptionsConfig holds the link-address and the options of the
+// Relay-Forward messages the v6 packets are wrapped in when forwarded to the
+// backends. Options which are nil aren't added.
+type RelayOptionsConfig struct {
+	// LinkAddr is the link-address, :: when nil
+	LinkAddr net.IP
+	// InheritLinkAddr uses the link-address of the relay closest to the
+	// client instead, :: if none was set
+	InheritLinkAddr bool
+	// InterfaceID is echoed by the backends in their replies (RFC 8415)
+	InterfaceID  []byte
+	RemoteID     *dhcpv6.OptRemoteID
+	SubscriberID []byte
+	// ClientLinkLayerAddr adds the MAC address of the client (RFC 6939), only
+	// to the packets coming straight from clients whose DUID is a DUID-LL or
+	// DUID-LLT with an Ethernet address, as it's taken from the DUID
+	ClientLinkLayerAddr bool
+}
+
+// relayOptionsSpec holds the raw json configuration of the Relay-Forward
+// messages.
+type relayOptionsSpec struct {
+	LinkAddress            string `json:"link_address"`
+	InterfaceID            string `json:"interface_id"`
+	RemoteID               string `json:"remote_id"`
+	EnterpriseNumber       uint32 `json:"enterprise_number"`
+	SubscriberID           string `json:"subscriber_id"`
+	ClientLinkLayerAddress bool   `json:"client_link_layer_address"`
+}
+
+func (c *configSpec) relayOptions() (*RelayOptionsConfig, error) {
+	if c.RelayOptions == nil {
+		return nil, nil
+	}
+	if c.Version != 6 {
+		return nil, fmt.Errorf("relay_options is only supported in v6")
+	}
+	spec := c.RelayOptions
+	ro := &RelayOptionsConfig{
+		ClientLinkLayerAddr: spec.ClientLinkLayerAddress,
+	}
+	switch spec.LinkAddress {
+	case "":
+	case LinkAddrRelay:
+		ro.InheritLinkAddr = true
+	default:
+		ip := net.ParseIP(spec.LinkAddress)
+		if ip == nil || ip.To4() != nil {
+			return nil, fmt.Errorf("Unable to parse relay_options link_address %s, expected an IPv6 address or '%s'",
+				spec.LinkAddress, LinkAddrRelay)
+		}
+		ro.LinkAddr = ip
+	}
+	if spec.InterfaceID != "" {
+		ro.InterfaceID = []byte(spec.InterfaceID)
+	}
+	if spec.RemoteID != "" {
+		ro.RemoteID = &dhcpv6.OptRemoteID{
+			EnterpriseNumber: spec.EnterpriseNumber,
+			RemoteID:         []byte(spec.RemoteID),
+		}
+	} else if spec.EnterpriseNumber != 0 {
+		return nil, fmt.Errorf("relay_options enterprise_number is only used with remote_id")
+	}
+	if spec.SubscriberID != "" {
+		ro.SubscriberID = []byte(spec.SubscriberID)
+	}
+	return ro, nil
+}
+
+// encapsulateRelay wraps packet, received from peer, in the Relay-Forward
+// message sent to the backends. config may be nil.
+func encapsulateRelay(config *RelayOptionsConfig, packet dhcpv6.DHCPv6, peer net.IP) *dhcpv6.RelayMessage {
+	linkAddr := net.IPv6zero
+	if config != nil && config.LinkAddr != nil {
+		linkAddr = config.LinkAddr
+	}
+	if config != nil && config.InheritLinkAddr {
+		if relayed := relayLinkAddr(packet); relayed != nil {
+			linkAddr = relayed
+		}
+	}
+	// this can only fail for message types other than Relay-Forward and
+	// Relay-Reply
+	relay, _ := dhcpv6.EncapsulateRelay(packet, dhcpv6.MessageTypeRelayForward, linkAddr, peer)
+	if config == nil {
+		return relay
+	}
+	if config.InterfaceID != nil {
+		relay.AddOption(dhcpv6.OptInterfaceID(config.InterfaceID))
+	}
+	if config.RemoteID != nil {
+		relay.AddOption(config.RemoteID)
+	}
+	if config.SubscriberID != nil {
+		relay.AddOption(&dhcpv6.OptionGeneric{
+			OptionCode: dhcpv6.OptionRelayAgentSubscriberID,
+			OptionData: config.SubscriberID,
+		})
+	}
+	if config.ClientLinkLayerAddr {
+		if mac := clientLinkLayerAddr(packet); mac != nil {
+			relay.AddOption(dhcpv6.OptClientLinkLayerAddress(iana.HWTypeEthernet, mac))
+		}
+	}
+	return relay
+}
+
+// clientLinkLayerAddr returns the MAC address of the client which sent packet
+// straight to dhcplb. dhcplb doesn't see the link-layer header, so it's taken
+// from the DUID: nil is returned for relayed packets, and for DUIDs other than
+// DUID-LL and DUID-LLT with an Ethernet address.
+func clientLinkLayerAddr(packet dhcpv6.DHCPv6) net.HardwareAddr {
+	msg, ok := packet.(*dhcpv6.Message)
+	if !ok {
+		return nil
+	}
+	var hwType iana.HWType
+	var addr net.HardwareAddr
+	switch duid := msg.Options.ClientID().(type) {
+	case *dhcpv6.DUIDLL:
+		hwType, addr = duid.HWType, duid.LinkLayerAddr
+	case *dhcpv6.DUIDLLT:
+		hwType, addr = duid.HWType, duid.LinkLayerAddr
+	default:
+		return nil
+	}
+	if hwType != iana.HWTypeEthernet || len(addr) != 6 {
+		return nil
+	}
+	return addr
+}
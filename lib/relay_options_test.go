@@ -0,0 +1,106 @@
+/**
+ * Copyright (c) Facebook, Inc. and its affiliates.
+ *
+ * This source code is licensed under the MIT license found in the
+ * LICENSE file in the root directory of this source tree.
+ */
+
+package dhcplb
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+func TestRelayOptionsSpec(t *testing.T) {
+	for _, spec := range []*relayOptionsSpec{
+		{LinkAddress: "10.0.0.1"},
+		{LinkAddress: "not-an-ip"},
+		{EnterpriseNumber: 40981},
+	} {
+		c := &configSpec{Version: 6, RelayOptions: spec}
+		if _, err := c.relayOptions(); err == nil {
+			t.Fatalf("Expected an error for %+v", spec)
+		}
+	}
+	c := &configSpec{Version: 4, RelayOptions: &relayOptionsSpec{}}
+	if _, err := c.relayOptions(); err == nil {
+		t.Fatalf("Expected an error for v4")
+	}
+}
+
+func TestEncapsulateRelay(t *testing.T) {
+	mac := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+	peer := net.ParseIP("fe80::1")
+	solicit, err := dhcpv6.FromBytes(newTestSolicit(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	relayed, err := dhcpv6.EncapsulateRelay(solicit, dhcpv6.MessageTypeRelayForward, net.ParseIP("2001:db8::1"), peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the MAC address of the client can't be found in other DUIDs
+	enterprise, err := dhcpv6.NewMessage(dhcpv6.WithClientID(&dhcpv6.DUIDEN{
+		EnterpriseNumber:     40981,
+		EnterpriseIdentifier: []byte{1, 2, 3},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &configSpec{Version: 6, RelayOptions: &relayOptionsSpec{
+		LinkAddress:            LinkAddrRelay,
+		InterfaceID:            "eth0",
+		RemoteID:               "remote",
+		EnterpriseNumber:       40981,
+		SubscriberID:           "subscriber",
+		ClientLinkLayerAddress: true,
+	}}
+	config, err := c.relayOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name     string
+		packet   dhcpv6.DHCPv6
+		linkAddr string
+		lla      bool
+	}{
+		{"from client", solicit, "::", true},
+		{"from relay", relayed, "2001:db8::1", false},
+		{"with a DUID-EN", enterprise, "::", false},
+	} {
+		// check what the backend would get
+		parsed, err := dhcpv6.FromBytes(encapsulateRelay(config, tt.packet, peer).ToBytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		relay := parsed.(*dhcpv6.RelayMessage)
+		if relay.LinkAddr.String() != tt.linkAddr {
+			t.Fatalf("%s: expected link-address %s, got %s", tt.name, tt.linkAddr, relay.LinkAddr)
+		}
+		if string(relay.Options.InterfaceID()) != "eth0" {
+			t.Fatalf("%s: unexpected interface-id %q", tt.name, relay.Options.InterfaceID())
+		}
+		if remoteID := relay.Options.RemoteID(); remoteID == nil || remoteID.EnterpriseNumber != 40981 || string(remoteID.RemoteID) != "remote" {
+			t.Fatalf("%s: unexpected remote-id %v", tt.name, remoteID)
+		}
+		if subscriberID := relay.Options.GetOne(dhcpv6.OptionRelayAgentSubscriberID); subscriberID == nil ||
+			!bytes.Equal(subscriberID.ToBytes(), []byte("subscriber")) {
+			t.Fatalf("%s: unexpected subscriber-id %v", tt.name, subscriberID)
+		}
+		if _, lla := relay.Options.ClientLinkLayerAddress(); (lla != nil) != tt.lla || (tt.lla && lla.String() != mac.String()) {
+			t.Fatalf("%s: unexpected client link-layer address %s", tt.name, lla)
+		}
+	}
+
+	// without relay options the packet is encapsulated as is
+	relay := encapsulateRelay(nil, solicit, peer)
+	if !relay.LinkAddr.Equal(net.IPv6zero) || len(relay.Options.Options) != 1 {
+		t.Fatalf("Unexpected relay message %s", relay.Summary())
+	}
+}
@@ -0,0 +1,147 @@
+/**
+ * Copyright (c) Facebook, Inc. and its affiliates.
+ *
+ * This source code is licensed under the MIT license found in the
+ * LICENSE file in the root directory of this source tree.
+ */
+
+package dhcplb
+
+import (
+	"net"
+	"time"
+
+	"github.com/golang/glog"
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// defaultRelayTableSize is the number of v4 requests remembered to send their
+// replies back to the relay agent they came from, when not specified in the
+// config.
+const defaultRelayTableSize = 4096
+
+// overrideServerTTL is how long the replies of a server are accepted after a
+// packet was sent to it because of an override.
+const overrideServerTTL = 5 * time.Minute
+
+// relayedRequest is the relay agent information of a v4 request before
+// dhcplb replaced its giaddr with its own.
+type relayedRequest struct {
+	giaddr net.IP
+	// relayAgentInfo is the option 82 set by the relay agent, nil if there
+	// was none
+	relayAgentInfo []byte
+}
+
+// relayTable remembers the v4 requests whose giaddr was replaced, by
+// transaction, client and relay agent, so that the replies coming back to
+// dhcplb are sent to the relay agent of the request, with the option 82 it
+// set. It's an LRU to bound memory usage, the replies to evicted requests
+// can't be relayed.
+type relayTable struct {
+	cache *lru.Cache[string, relayedRequest]
+}
+
+func newRelayTable(size int) (*relayTable, error) {
+	cache, err := lru.New[string, relayedRequest](size)
+	if err != nil {
+		return nil, err
+	}
+	return &relayTable{cache: cache}, nil
+}
+
+func (t *relayTable) resize(size int) {
+	if evicted := t.cache.Resize(size); evicted > 0 {
+		glog.Infof("Relay table resized to %d requests, %d evicted", size, evicted)
+	}
+}
+
+// relayKey identifies a request relayed through dhcplb, and its replies which
+// echo its option 82. The link selection sub-option holds the giaddr of the
+// relay agent, so that the same transaction forwarded by redundant relays
+// isn't mixed up.
+func relayKey(packet *dhcpv4.DHCPv4) string {
+	key := string(packet.TransactionID[:]) + string(packet.ClientHWAddr)
+	if info := packet.RelayAgentInfo(); info != nil {
+		key += string(info.Get(dhcpv4.LinkSelectionSubOption))
+	}
+	return key
+}
+
+// originalRelay returns the relay agent information of request, before dhcplb
+// changes its option 82.
+func originalRelay(request *dhcpv4.DHCPv4) relayedRequest {
+	original := relayedRequest{giaddr: request.GatewayIPAddr}
+	if info := request.Options.Get(dhcpv4.OptionRelayAgentInformation); info != nil {
+		// the packet buffer is reused once handled
+		original.relayAgentInfo = append([]byte(nil), info...)
+	}
+	return original
+}
+
+// relayThrough replaces the giaddr of request with giaddr, so that the
+// backends send their replies to dhcplb, which restores original in them. The
+// backends keep allocating from the subnet of the relay agent thanks to the
+// link selection sub-option (RFC 3527), which is added to option 82 unless
+// already set. Requests with a zero giaddr come from clients dhcplb is the
+// relay of, their replies are sent to the client.
+func (t *relayTable) relayThrough(request *dhcpv4.DHCPv4, original relayedRequest, giaddr net.IP) {
+	if !original.giaddr.IsUnspecified() {
+		linkSelection := dhcpv4.OptGeneric(dhcpv4.LinkSelectionSubOption, original.giaddr.To4())
+		if info := request.RelayAgentInfo(); info == nil {
+			request.UpdateOption(dhcpv4.OptRelayAgentInfo(linkSelection))
+		} else if !info.Has(dhcpv4.LinkSelectionSubOption) {
+			info.Update(linkSelection)
+			request.UpdateOption(dhcpv4.Option{Code: dhcpv4.OptionRelayAgentInformation, Value: *info})
+		}
+	}
+	request.GatewayIPAddr = giaddr
+	t.cache.Add(relayKey(request), original)
+}
+
+// restore puts back the giaddr and option 82 of the request reply is for. It
+// returns false if the request isn't in the table, eg because it was
+// evicted.
+func (t *relayTable) restore(reply *dhcpv4.DHCPv4) bool {
+	original, ok := t.cache.Get(relayKey(reply))
+	if !ok {
+		return false
+	}
+	reply.GatewayIPAddr = original.giaddr
+	if original.relayAgentInfo == nil {
+		reply.Options.Del(dhcpv4.OptionRelayAgentInformation)
+	} else {
+		reply.UpdateOption(dhcpv4.OptGeneric(dhcpv4.OptionRelayAgentInformation, original.relayAgentInfo))
+	}
+	return true
+}
+
+// sentToOverride records that a packet was sent to server because of an
+// override, its replies are accepted for overrideServerTTL.
+func (s *Server) sentToOverride(server *DHCPServer) {
+	key := server.Address.String()
+	// only refresh the entry from time to time, rather than for every packet
+	if last, ok := s.overrideServers.Load(key); ok && time.Since(last.(time.Time)) < overrideServerTTL/2 {
+		return
+	}
+	s.overrideServers.Store(key, time.Now())
+}
+
+// isOverrideServer returns true if a packet was recently sent to ip because
+// of an override.
+func (s *Server) isOverrideServer(ip net.IP) bool {
+	last, ok := s.overrideServers.Load(ip.String())
+	return ok && time.Since(last.(time.Time)) < overrideServerTTL
+}
+
+// sweepOverrideServers forgets the servers no packet was sent to for
+// overrideServerTTL.
+func (s *Server) sweepOverrideServers(now time.Time) {
+	s.overrideServers.Range(func(key, last interface{}) bool {
+		if now.Sub(last.(time.Time)) >= overrideServerTTL {
+			s.overrideServers.Delete(key)
+		}
+		return true
+	})
+}
@@ -0,0 +1,165 @@
+/**
+ * Copyright (c) Facebook, Inc. and its affiliates.
+ *
+ * This source code is licensed under the MIT license found in the
+ * LICENSE file in the root directory of this source tree.
+ */
+
+package dhcplb
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+func TestRelayThrough(t *testing.T) {
+	backend, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	addr := backend.LocalAddr().(*net.UDPAddr)
+	config := newTestConfig(4, []*DHCPServer{NewDHCPServer("backend", addr.IP, addr.Port)})
+	config.Giaddr = net.ParseIP("127.0.0.1").To4()
+	config.RewriteGiaddr = true
+	config.RelayAgentInfo = &RelayAgentInfoConfig{Policy: RelayInfoReplace, RemoteID: []byte("dhcplb")}
+	config.ReplyTracking = &ReplyTrackingConfig{ReplyTimeout: time.Minute}
+	server := newTestServer(t, config)
+	defer server.conn.Close()
+
+	request, err := dhcpv4.FromBytes(newTestDiscover(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.UpdateOption(dhcpv4.OptRelayAgentInfo(
+		dhcpv4.OptGeneric(dhcpv4.AgentCircuitIDSubOption, []byte("circuit"))))
+	server.handlePacket(context.Background(), request.ToBytes(), &net.UDPAddr{IP: request.GatewayIPAddr, Port: 67})
+
+	buffer := make([]byte, 1500)
+	backend.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := backend.ReadFromUDP(buffer)
+	if err != nil {
+		t.Fatalf("Request wasn't forwarded: %s", err)
+	}
+	forwarded, err := dhcpv4.FromBytes(buffer[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the backend replies to dhcplb, and allocates from the relay's subnet,
+	// the option 82 of the relay was replaced
+	if !forwarded.GatewayIPAddr.Equal(config.Giaddr) {
+		t.Fatalf("Expected giaddr %s, got %s", config.Giaddr, forwarded.GatewayIPAddr)
+	}
+	info := forwarded.RelayAgentInfo()
+	if info == nil || !net.IP(info.Get(dhcpv4.LinkSelectionSubOption)).Equal(request.GatewayIPAddr) ||
+		info.Has(dhcpv4.AgentCircuitIDSubOption) || string(info.Get(dhcpv4.AgentRemoteIDSubOption)) != "dhcplb" {
+		t.Fatalf("Unexpected option 82 %s", info)
+	}
+
+	// the reply goes back to the relay with the option 82 it set
+	reply, err := dhcpv4.NewReplyFromRequest(forwarded,
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeOffer),
+		dhcpv4.WithOption(dhcpv4.Option{Code: dhcpv4.OptionRelayAgentInformation, Value: *info}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest, err := server.prepareV4Reply(config, reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !dest.IP.Equal(request.GatewayIPAddr) || dest.Port != dhcpv4.ServerPort {
+		t.Fatalf("Expected the reply to be sent to %s:67, got %s", request.GatewayIPAddr, dest)
+	}
+	if !reply.GatewayIPAddr.Equal(request.GatewayIPAddr) {
+		t.Fatalf("Expected giaddr %s to be restored, got %s", request.GatewayIPAddr, reply.GatewayIPAddr)
+	}
+	if !bytes.Equal(reply.Options.Get(dhcpv4.OptionRelayAgentInformation), request.Options.Get(dhcpv4.OptionRelayAgentInformation)) {
+		t.Fatalf("Expected option 82 to be restored, got %s", reply.RelayAgentInfo())
+	}
+
+	// the replies come back through dhcplb, so they are tracked
+	if pending := len(server.replies.servers[addr.IP.String()].pending); pending != 1 {
+		t.Fatalf("Expected the request to be tracked, got %d pending", pending)
+	}
+	reply, err = dhcpv4.NewReplyFromRequest(forwarded,
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeOffer),
+		dhcpv4.WithOption(dhcpv4.Option{Code: dhcpv4.OptionRelayAgentInformation, Value: *info}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.health.setServers([]*DHCPServer{NewDHCPServer("backend", addr.IP, addr.Port)})
+	server.handlePacket(context.Background(), reply.ToBytes(), addr)
+	if replied := server.replies.servers[addr.IP.String()].replied; replied != 1 {
+		t.Fatalf("Expected the reply to be tracked, got %d replied", replied)
+	}
+}
+
+func TestOverrideServersExpire(t *testing.T) {
+	server := &Server{health: newHealthChecker()}
+	fresh := NewDHCPServer("fresh", net.ParseIP("10.0.0.1"), 67)
+	server.sentToOverride(fresh)
+	server.overrideServers.Store("10.0.0.2", time.Now().Add(-overrideServerTTL))
+	if !server.isKnownServer(fresh.Address) {
+		t.Fatalf("Replies of %s should be accepted", fresh.Address)
+	}
+	if server.isKnownServer(net.ParseIP("10.0.0.2")) {
+		t.Fatalf("Replies of an expired override server shouldn't be accepted")
+	}
+	server.sweepOverrideServers(time.Now())
+	if _, ok := server.overrideServers.Load("10.0.0.2"); ok {
+		t.Fatalf("Expired override server wasn't swept")
+	}
+}
+
+func TestRelayTableRedundantRelays(t *testing.T) {
+	config := newTestConfig(4, nil)
+	config.Giaddr = net.ParseIP("10.0.0.254").To4()
+	config.RewriteGiaddr = true
+	relays, err := newRelayTable(config.RelayTableSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{config: config, relays: relays}
+
+	// the same transaction forwarded by two relays of the client's link
+	var forwarded []*dhcpv4.DHCPv4
+	for _, giaddr := range []string{"10.1.0.1", "10.1.0.2"} {
+		request, err := dhcpv4.FromBytes(newTestDiscover(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.GatewayIPAddr = net.ParseIP(giaddr).To4()
+		relays.relayThrough(request, originalRelay(request), config.Giaddr)
+		forwarded = append(forwarded, request)
+	}
+	for i, giaddr := range []string{"10.1.0.1", "10.1.0.2"} {
+		reply, err := dhcpv4.NewReplyFromRequest(forwarded[i],
+			dhcpv4.WithOption(dhcpv4.Option{Code: dhcpv4.OptionRelayAgentInformation, Value: *forwarded[i].RelayAgentInfo()}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		dest, err := server.prepareV4Reply(config, reply)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dest.IP.String() != giaddr {
+			t.Fatalf("Expected the reply to be sent to %s, got %s", giaddr, dest)
+		}
+	}
+
+	// replies whose request was evicted can't be relayed
+	relays.resize(1)
+	reply, err := dhcpv4.NewReplyFromRequest(forwarded[0],
+		dhcpv4.WithOption(dhcpv4.Option{Code: dhcpv4.OptionRelayAgentInformation, Value: *forwarded[0].RelayAgentInfo()}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dest, err := server.prepareV4Reply(config, reply); err == nil {
+		t.Fatalf("Expected an error for an evicted request, got %s", dest)
+	}
+}
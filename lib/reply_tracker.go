@@ -0,0 +1,208 @@
+/**
+ * Copyright (c) Facebook, Inc. and its affiliates.
+ *
+ * This source code is licensed under the MIT license found in the
+ * LICENSE file in the root directory of this source tree.
+ */
+
+package dhcplb
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	defaultReplyTrackingWindow   = time.Minute
+	defaultReplyTrackingTimeout  = 5 * time.Second
+	defaultReplyTrackingHoldDown = 5 * time.Minute
+	// maxPendingPerServer bounds the memory used to track transactions of a
+	// single backend, new transactions aren't tracked past this limit.
+	maxPendingPerServer = 4096
+)
+
+// ReplyTrackingConfig holds the settings used to passively detect backend
+// DHCP servers which stopped replying. The replies must go through dhcplb,
+// which is the case in v6, and in v4 when Config.RewriteGiaddr is set.
+type ReplyTrackingConfig struct {
+	// Window is how often reply ratios are evaluated.
+	Window time.Duration
+	// HoldDown is how long a degraded server is kept out of rotation when it
+	// gets too little traffic to be evaluated again.
+	HoldDown time.Duration
+	// ReplyTimeout is how long to wait for a reply before counting a
+	// forwarded request as unanswered.
+	ReplyTimeout time.Duration
+	// MinRequests is the minimum number of requests needed in a window to
+	// evaluate the reply ratio of a server.
+	MinRequests int
+	// MinReplyRatio is the ratio of replied/forwarded requests below which a
+	// server is marked as degraded. With 0, servers are never degraded.
+	MinReplyRatio float64
+}
+
+type replyStats struct {
+	pending    map[string]time.Time
+	replied    int
+	unanswered int
+	degraded   bool
+	// degradedAt is when the server was last marked as degraded
+	degradedAt time.Time
+}
+
+// replyTracker correlates the requests forwarded to each backend with the
+// replies coming back from it.
+type replyTracker struct {
+	lock    sync.Mutex
+	servers map[string]*replyStats
+	changed chan struct{}
+}
+
+func newReplyTracker() *replyTracker {
+	return &replyTracker{
+		servers: make(map[string]*replyStats),
+		changed: make(chan struct{}, 1),
+	}
+}
+
+// forwarded records a request with transaction id xid sent to server.
+func (r *replyTracker) forwarded(server *DHCPServer, xid []byte) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	key := server.Address.String()
+	stats, ok := r.servers[key]
+	if !ok {
+		stats = &replyStats{pending: make(map[string]time.Time)}
+		r.servers[key] = stats
+	}
+	if len(stats.pending) >= maxPendingPerServer {
+		return
+	}
+	stats.pending[string(xid)] = time.Now()
+}
+
+// replied records a reply with transaction id xid coming from addr.
+func (r *replyTracker) replied(addr net.IP, xid []byte) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	stats, ok := r.servers[addr.String()]
+	if !ok {
+		return
+	}
+	if _, ok := stats.pending[string(xid)]; ok {
+		delete(stats.pending, string(xid))
+		stats.replied++
+	}
+}
+
+// isDegraded returns true if the reply ratio of server was below the
+// configured threshold in the last window.
+func (r *replyTracker) isDegraded(server *DHCPServer) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	stats, ok := r.servers[server.Address.String()]
+	return ok && stats.degraded
+}
+
+// evaluate computes the reply ratio of every server over the last window and
+// resets the counters. It returns true if any server changed state.
+func (r *replyTracker) evaluate(config *ReplyTrackingConfig) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	changed := false
+	now := time.Now()
+	for addr, stats := range r.servers {
+		for xid, sent := range stats.pending {
+			if now.Sub(sent) > config.ReplyTimeout {
+				delete(stats.pending, xid)
+				stats.unanswered++
+			}
+		}
+		total := stats.replied + stats.unanswered
+		degraded := stats.degraded
+		if total > 0 && total >= config.MinRequests {
+			ratio := float64(stats.replied) / float64(total)
+			degraded = ratio < config.MinReplyRatio
+			if degraded {
+				if !stats.degraded {
+					glog.Errorf("Server %s replied to %d/%d requests, marking it as degraded", addr, stats.replied, total)
+				}
+				stats.degradedAt = now
+			}
+		} else if degraded && now.Sub(stats.degradedAt) >= config.HoldDown {
+			// a degraded server gets no traffic, give it another chance
+			// once the hold-down expired
+			degraded = false
+		}
+		if !degraded && stats.degraded {
+			glog.Infof("Server %s is no longer degraded", addr)
+		}
+		if degraded != stats.degraded {
+			changed = true
+		}
+		stats.degraded = degraded
+		stats.replied = 0
+		stats.unanswered = 0
+		if total == 0 && len(stats.pending) == 0 && !degraded {
+			// forget about servers we no longer send traffic to
+			delete(r.servers, addr)
+		}
+	}
+	return changed
+}
+
+// reset forgets all the tracked transactions, it's used when reply tracking
+// gets disabled.
+func (r *replyTracker) reset() {
+	r.lock.Lock()
+	changed := false
+	for _, stats := range r.servers {
+		if stats.degraded {
+			changed = true
+		}
+	}
+	r.servers = make(map[string]*replyStats)
+	r.lock.Unlock()
+	if changed {
+		r.notify()
+	}
+}
+
+// run evaluates reply ratios every ReplyTrackingConfig.Window.
+func (r *replyTracker) run(ctx context.Context, s *Server) {
+	for {
+		config := s.GetConfig()
+		window := defaultReplyTrackingWindow
+		if config.ReplyTracking != nil {
+			window = config.ReplyTracking.Window
+		}
+		select {
+		case <-time.NewTimer(window).C:
+		case <-ctx.Done():
+			return
+		}
+
+		config = s.GetConfig()
+		if config.ReplyTracking == nil {
+			r.reset()
+			continue
+		}
+		if r.evaluate(config.ReplyTracking) {
+			r.notify()
+		}
+	}
+}
+
+func (r *replyTracker) notify() {
+	select {
+	case r.changed <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,90 @@
+/**
+ * Copyright (c) Facebook, Inc. and its affiliates.
+ *
+ * This source code is licensed under the MIT license found in the
+ * LICENSE file in the root directory of this source tree.
+ */
+
+package dhcplb
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReplyTrackerDegraded(t *testing.T) {
+	config := &ReplyTrackingConfig{
+		HoldDown:      time.Hour,
+		ReplyTimeout:  0,
+		MinRequests:   4,
+		MinReplyRatio: 0.5,
+	}
+	good := NewDHCPServer("good", net.ParseIP("2001:db8::1"), 547)
+	bad := NewDHCPServer("bad", net.ParseIP("2001:db8::2"), 547)
+	r := newReplyTracker()
+	for i := byte(0); i < 4; i++ {
+		xid := []byte{0, 0, i}
+		r.forwarded(good, xid)
+		r.forwarded(bad, xid)
+		r.replied(good.Address, xid)
+	}
+	// a single reply out of 4 requests
+	r.replied(bad.Address, []byte{0, 0, 0})
+	// replies for unknown transactions are ignored
+	r.replied(bad.Address, []byte{1, 1, 1})
+	time.Sleep(time.Millisecond)
+
+	if !r.evaluate(config) {
+		t.Fatalf("Expected a server to change state")
+	}
+	if r.isDegraded(good) {
+		t.Fatalf("Server replying to all requests shouldn't be degraded")
+	}
+	if !r.isDegraded(bad) {
+		t.Fatalf("Server replying to 1/4 requests should be degraded")
+	}
+
+	// no traffic is sent to a degraded server, it stays out of rotation
+	// until the hold-down expires
+	if r.evaluate(config) || !r.isDegraded(bad) {
+		t.Fatalf("Server without traffic should stay degraded during the hold-down")
+	}
+	config.HoldDown = 0
+	if !r.evaluate(config) {
+		t.Fatalf("Expected a server to change state")
+	}
+	if r.isDegraded(bad) {
+		t.Fatalf("Server should get back in rotation after the hold-down")
+	}
+}
+
+func TestReplyTrackingV4(t *testing.T) {
+	spec := &configSpec{Version: 4, ReplyTracking: &replyTrackingSpec{}}
+	if _, err := spec.replyTracking(); err == nil {
+		t.Fatalf("reply_tracking should be rejected in v4 without giaddr")
+	}
+	spec.Giaddr = "10.0.0.5"
+	rt, err := spec.replyTracking()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rt.HoldDown != defaultReplyTrackingHoldDown {
+		t.Fatalf("Expected the default hold_down, got %s", rt.HoldDown)
+	}
+}
+
+func TestReplyTrackerMinRequests(t *testing.T) {
+	config := &ReplyTrackingConfig{
+		ReplyTimeout:  0,
+		MinRequests:   10,
+		MinReplyRatio: 0.5,
+	}
+	server := NewDHCPServer("bad", net.ParseIP("2001:db8::2"), 547)
+	r := newReplyTracker()
+	r.forwarded(server, []byte{0, 0, 1})
+	time.Sleep(time.Millisecond)
+	if r.evaluate(config) || r.isDegraded(server) {
+		t.Fatalf("Server shouldn't be degraded with less than %d requests", config.MinRequests)
+	}
+}
@@ -0,0 +1,45 @@
+/**
+ * Copyright (c) Facebook, Inc. and its affiliates.
+ *
+ * This source code is licensed under the MIT license found in the
+ * LICENSE file in the root directory of this source tree.
+ */
+
+package dhcplb
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+// listenUDP opens config.ListenSockets sockets bound to config.Addr. When more
+// than one socket is requested they are opened with SO_REUSEPORT, so that the
+// kernel spreads the incoming packets across them.
+func listenUDP(config *Config) ([]*net.UDPConn, error) {
+	if config.ListenSockets <= 1 {
+		conn, err := net.ListenUDP("udp", config.Addr)
+		if err != nil {
+			return nil, err
+		}
+		return []*net.UDPConn{conn}, nil
+	}
+
+	lc := net.ListenConfig{Control: setReusePort}
+	conns := make([]*net.UDPConn, 0, config.ListenSockets)
+	addr := config.Addr.String()
+	for i := 0; i < config.ListenSockets; i++ {
+		pc, err := lc.ListenPacket(context.Background(), "udp", addr)
+		if err != nil {
+			for _, conn := range conns {
+				conn.Close()
+			}
+			return nil, fmt.Errorf("Failed to open socket %d on %s: %s", i, config.Addr, err)
+		}
+		conns = append(conns, pc.(*net.UDPConn))
+		// with port 0 the first socket gets an ephemeral port, the others
+		// have to share it
+		addr = conns[0].LocalAddr().String()
+	}
+	return conns, nil
+}
@@ -17,13 +17,15 @@ import (
 )
 
 type roundRobin struct {
-	lock       sync.RWMutex
-	stable     []*DHCPServer
-	rc         []*DHCPServer
-	rcRatio    uint32
-	iterStable int
-	iterRC     int
-	iterList   int // iterator used by SelectServerFromList, can be used in stable/rc or passing list manually
+	lock    sync.Mutex
+	stable  []*DHCPServer
+	rc      []*DHCPServer
+	rcRatio uint32
+	// current weights used by the smooth weighted round robin on the stable
+	// and rc lists, reset every time a list is updated
+	stableWeights []int
+	rcWeights     []int
+	iterList      int // iterator used by SelectServerFromList when passing list manually
 }
 
 func (rr *roundRobin) Name() string {
@@ -42,15 +44,16 @@ func (rr *roundRobin) SetRCRatio(ratio uint32) {
 }
 
 func (rr *roundRobin) SelectServerFromList(list []*DHCPServer, message *DHCPMessage) (*DHCPServer, error) {
-	rr.lock.RLock()
-	defer rr.lock.RUnlock()
+	rr.lock.Lock()
+	defer rr.lock.Unlock()
 
 	if len(list) == 0 {
 		return nil, errors.New("Server list is empty")
 	}
 	// no guarantee that lists are the same size, so modulo before incrementing
-	rr.iterList = rr.iterList % len(list)
-	server := list[rr.iterList]
+	total := totalWeight(list)
+	rr.iterList = rr.iterList % total
+	server := selectWeighted(list, rr.iterList)
 	rr.iterList++
 	return server, nil
 }
@@ -60,27 +63,44 @@ func (rr *roundRobin) SelectRatioBasedDhcpServer(message *DHCPMessage) (server *
 	hash := rr.getHash(message.ClientID)
 
 	rr.lock.Lock()
+	defer rr.lock.Unlock()
 
-	if hash%100 < rr.rcRatio {
-		rr.iterList = rr.iterRC
-		rr.iterRC++
-		rr.lock.Unlock()
-		return rr.SelectServerFromList(rr.rc, message)
+	if hash%100 < atomic.LoadUint32(&rr.rcRatio) {
+		return smoothWeighted(rr.rc, rr.rcWeights)
 	}
 	//otherwise go stable
-	rr.iterList = rr.iterStable
-	rr.iterStable++
-	rr.lock.Unlock()
-	return rr.SelectServerFromList(rr.stable, message)
+	return smoothWeighted(rr.stable, rr.stableWeights)
+}
+
+// smoothWeighted implements the smooth weighted round robin used by nginx:
+// at every pick each server's current weight is increased by its weight and
+// the server with the highest current weight is picked and has its current
+// weight decreased by the total. This spreads the picks of heavier servers
+// instead of sending them bursts of requests. With equal weights this is a
+// plain round robin.
+func smoothWeighted(list []*DHCPServer, current []int) (*DHCPServer, error) {
+	if len(list) == 0 {
+		return nil, errors.New("Server list is empty")
+	}
+	best := 0
+	total := 0
+	for i, server := range list {
+		current[i] += server.weight()
+		total += server.weight()
+		if current[i] > current[best] {
+			best = i
+		}
+	}
+	current[best] -= total
+	return list[best], nil
 }
 
-func (rr *roundRobin) UpdateServerList(name string, list []*DHCPServer, ptr *[]*DHCPServer) error {
+func (rr *roundRobin) UpdateServerList(name string, list []*DHCPServer, ptr *[]*DHCPServer, weights *[]int) error {
 	rr.lock.Lock()
 	defer rr.lock.Unlock()
 
 	*ptr = list
-	rr.iterStable = 0
-	rr.iterRC = 0
+	*weights = make([]int, len(list))
 	glog.Infof("List of available %s servers:", name)
 	for _, server := range *ptr {
 		glog.Infof("%s", server)
@@ -89,9 +109,9 @@ func (rr *roundRobin) UpdateServerList(name string, list []*DHCPServer, ptr *[]*
 }
 
 func (rr *roundRobin) UpdateStableServerList(list []*DHCPServer) error {
-	return rr.UpdateServerList("stable", list, &rr.stable)
+	return rr.UpdateServerList("stable", list, &rr.stable, &rr.stableWeights)
 }
 
 func (rr *roundRobin) UpdateRCServerList(list []*DHCPServer) error {
-	return rr.UpdateServerList("rc", list, &rr.rc)
+	return rr.UpdateServerList("rc", list, &rr.rc, &rr.rcWeights)
 }
@@ -43,3 +43,27 @@ func TestRRBalance(t *testing.T) {
 		}
 	}
 }
+
+func TestRRWeighted(t *testing.T) {
+	subject := new(roundRobin)
+	servers := []*DHCPServer{
+		{Port: 0, Weight: 5},
+		{Port: 1},
+		{Port: 2},
+	}
+	subject.UpdateStableServerList(servers)
+	msg := DHCPMessage{
+		ClientID: []byte{0},
+	}
+	// smooth weighted round robin interleaves the picks of the heavier server
+	expected := []int{0, 0, 1, 0, 2, 0, 0}
+	for i, port := range expected {
+		server, err := subject.SelectRatioBasedDhcpServer(&msg)
+		if err != nil {
+			t.Fatalf("Unexpected error selecting server: %s", err)
+		}
+		if server.Port != port {
+			t.Fatalf("Pick %d: chose server %d, expected %d", i, server.Port, port)
+		}
+	}
+}
@@ -9,22 +9,53 @@ package dhcplb
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"io"
 	"net"
+	"reflect"
+	"strconv"
+	"sync"
 	"sync/atomic"
+	"time"
 	"unsafe"
 
 	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 // UDP acceptor
 type Server struct {
-	server        bool
-	conn          *net.UDPConn
-	logger        *loggerHelper
-	config        *Config
+	server bool
+	// conn is used to send packets, it's the first of conns which are all
+	// bound to the same address
+	conn   *net.UDPConn
+	conns  []*net.UDPConn
+	logger *loggerHelper
+	config *Config
+	// serversLock guards stableServers and rcServers, which are replaced
+	// by the goroutine updating the server list
+	serversLock   sync.RWMutex
 	stableServers []*DHCPServer
 	rcServers     []*DHCPServer
 	throttle      *Throttle
+	// throttleSize is the throttle_cache_size gauge of the server's version
+	throttleSize prometheus.Gauge
+	health       *healthChecker
+	replies      *replyTracker
+	admin        *adminState
+	affinity     *affinityTable
+	loops        *loopDetector
+	inflight     sync.WaitGroup
+	workers      *workerPool
+	writer       *batchWriter
+	// stopping is closed when ListenAndServe is asked to stop
+	stopping chan struct{}
+	buffers  sync.Pool
+	// overrideServers holds when packets were last sent to the servers of
+	// overrides, by address, see isKnownServer
+	overrideServers sync.Map
+	relays          *relayTable
 }
 
 // returns a pointer to the current config struct, so that if it does get changed while being used,
@@ -33,42 +64,177 @@ func (s *Server) GetConfig() *Config {
 	return s.config
 }
 
-// ListenAndServe starts the server
+// ListenAndServe starts the server. When ctx is cancelled it stops reading
+// packets, waits up to Config.ShutdownTimeout for the packets being handled to
+// be sent, and then closes the sockets before returning.
 func (s *Server) ListenAndServe(ctx context.Context) error {
 	if !s.server {
-		s.startUpdatingServerList()
+		s.startUpdatingServerList(ctx)
+		go s.sweepOverrides(ctx)
 	}
 
-	glog.Infof("Started server, processing DHCP requests...")
+	// packets still being handled when ctx is cancelled are drained with
+	// their own context, which is cancelled once the shutdown is over
+	handling, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	for {
-		s.handleConnection(ctx)
+	// unblock the read loops when we are asked to stop, the sockets stay open
+	// so that the packets being handled can still be sent
+	s.stopping = make(chan struct{})
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-ctx.Done():
+			close(s.stopping)
+			for _, conn := range s.conns {
+				conn.SetReadDeadline(time.Now())
+			}
+		case <-stopped:
+		}
+	}()
+
+	if config := s.GetConfig(); config.WorkerPool != nil {
+		s.workers = newWorkerPool(config.WorkerPool, config.Version)
+		s.workers.start(handling, s, config.WorkerPool.Workers)
+	}
+
+	batchSize := s.GetConfig().BatchSize
+	if batchSize > 1 {
+		glog.Infof("Reading and writing packets in batches of %d", batchSize)
+		s.writer = newBatchWriter(s.conn, s.GetConfig().Version, batchSize)
+		go s.writer.run()
+	}
+
+	glog.Infof("Started server on %d socket(s), processing DHCP requests...", len(s.conns))
+
+	// one read loop per socket
+	var readers sync.WaitGroup
+	for _, conn := range s.conns {
+		readers.Add(1)
+		go func(conn *net.UDPConn) {
+			defer readers.Done()
+			if batchSize > 1 {
+				s.readBatches(handling, conn, batchSize)
+				return
+			}
+			for !s.isStopping() {
+				s.handleConnection(handling, conn)
+			}
+		}(conn)
+	}
+	readers.Wait()
+	if s.workers != nil {
+		s.workers.close()
+	}
+	return s.shutdown()
+}
+
+// isStopping returns true once ListenAndServe was asked to stop, the read
+// loops return when it does.
+func (s *Server) isStopping() bool {
+	select {
+	case <-s.stopping:
+		return true
+	default:
+		return false
 	}
 }
 
+// shutdown waits for the packets being handled, then stops the batch writer
+// and closes the sockets.
+func (s *Server) shutdown() error {
+	config := s.GetConfig()
+	glog.Infof("Stopping server, waiting up to %s for in-flight packets", config.ShutdownTimeout)
+	done := make(chan struct{})
+	go func() {
+		s.inflight.Wait()
+		close(done)
+	}()
+	var err error
+	select {
+	case <-done:
+		glog.Infof("All in-flight packets handled")
+	case <-time.After(config.ShutdownTimeout):
+		err = fmt.Errorf("timed out waiting for in-flight packets after %s", config.ShutdownTimeout)
+	}
+	if s.writer != nil {
+		s.writer.close()
+	}
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	if closer, ok := config.HostSourcer.(io.Closer); ok {
+		closer.Close()
+	}
+	return err
+}
+
 // SetConfig updates the server config
 func (s *Server) SetConfig(config *Config) {
 	glog.Infof("Updating server config")
 	// update server list because Algorithm instance was recreated
-	config.Algorithm.UpdateStableServerList(s.stableServers)
-	config.Algorithm.UpdateRCServerList(s.rcServers)
-	atomic.SwapPointer((*unsafe.Pointer)(unsafe.Pointer(&s.config)), unsafe.Pointer(config))
+	stable, rc := s.serverLists()
+	config.Algorithm.UpdateStableServerList(stable)
+	config.Algorithm.UpdateRCServerList(rc)
+	old := (*Config)(atomic.SwapPointer((*unsafe.Pointer)(unsafe.Pointer(&s.config)), unsafe.Pointer(config)))
+	// a new FileSourcer is created on every reload, stop watching the files
+	// of the old one
+	if sourcer, ok := old.HostSourcer.(*FileSourcer); ok && sourcer != config.HostSourcer {
+		sourcer.Close()
+	}
 	// update the throttle rate
 	s.throttle.setRate(config.Rate)
+	if old.AffinitySize != config.AffinitySize {
+		s.affinity.resize(config.AffinitySize)
+	}
+	if old.RelayTableSize != config.RelayTableSize {
+		s.relays.resize(config.RelayTableSize)
+	}
+	if !reflect.DeepEqual(old.WorkerPool, config.WorkerPool) {
+		glog.Warningf("Worker pool settings changed, restart dhcplb to apply them")
+	}
+	if old.BatchSize != config.BatchSize {
+		glog.Warningf("Batch size changed, restart dhcplb to apply it")
+	}
+	if old.Addr.String() != config.Addr.String() || old.ListenSockets != config.ListenSockets {
+		glog.Warningf("Listening sockets settings changed, restart dhcplb to apply them")
+	}
 	glog.Infof("Updated server config")
 }
 
 // HasServers checks if the list of backend servers is not empty
 func (s *Server) HasServers() bool {
-	return len(s.stableServers) > 0 || len(s.rcServers) > 0
+	stable, rc := s.serverLists()
+	return len(stable) > 0 || len(rc) > 0
+}
+
+// isKnownServer returns true if ip is the address of a server from the
+// sourcer, or of one packets were sent to because of an override. Only the
+// replies of known servers are relayed.
+func (s *Server) isKnownServer(ip net.IP) bool {
+	if s.health.knows(ip) {
+		return true
+	}
+	return s.isOverrideServer(ip)
+}
+
+// serverLists returns the stable and RC servers currently in rotation.
+func (s *Server) serverLists() (stable, rc []*DHCPServer) {
+	s.serversLock.RLock()
+	defer s.serversLock.RUnlock()
+	return s.stableServers, s.rcServers
 }
 
 // NewServer initialized a Server before returning it.
 func NewServer(config *Config, serverMode bool, personalizedLogger PersonalizedLogger) (*Server, error) {
-	conn, err := net.ListenUDP("udp", config.Addr)
+	conns, err := listenUDP(config)
 	if err != nil {
 		return nil, err
 	}
+	if effective, err := json.Marshal(newConfigView(config)); err == nil {
+		glog.Infof("Effective v%d config: %s", config.Version, effective)
+	}
 
 	// setup logger
 	var loggerHelper = &loggerHelper{
@@ -77,10 +243,14 @@ func NewServer(config *Config, serverMode bool, personalizedLogger PersonalizedL
 	}
 
 	server := &Server{
-		server: serverMode,
-		conn:   conn,
-		logger: loggerHelper,
-		config: config,
+		server:  serverMode,
+		conn:    conns[0],
+		conns:   conns,
+		logger:  loggerHelper,
+		config:  config,
+		health:  newHealthChecker(),
+		replies: newReplyTracker(),
+		admin:   newAdminState(),
 	}
 
 	glog.Infof("Setting up throttle: Cache Size: %d - Cache Rate: %d - Request Rate: %d",
@@ -90,6 +260,25 @@ func NewServer(config *Config, serverMode bool, personalizedLogger PersonalizedL
 		return nil, err
 	}
 	server.throttle = throttle
+	server.throttleSize = throttleCacheSize.WithLabelValues(strconv.Itoa(config.Version))
+
+	affinity, err := newAffinityTable(config.AffinitySize)
+	if err != nil {
+		return nil, err
+	}
+	server.affinity = affinity
+
+	loops, err := newLoopDetector(loopTableSize)
+	if err != nil {
+		return nil, err
+	}
+	server.loops = loops
+
+	relays, err := newRelayTable(config.RelayTableSize)
+	if err != nil {
+		return nil, err
+	}
+	server.relays = relays
 
 	return server, nil
 }
@@ -0,0 +1,225 @@
+/**
+ * Copyright (c) Facebook, Inc. and its affiliates.
+ *
+ * This source code is licensed under the MIT license found in the
+ * LICENSE file in the root directory of this source tree.
+ */
+
+package dhcplb
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+// staticSourcer is a DHCPServerSourcer returning a fixed list of servers.
+type staticSourcer struct {
+	stable []*DHCPServer
+}
+
+func (s *staticSourcer) GetStableServers() ([]*DHCPServer, error) {
+	return s.stable, nil
+}
+
+func (s *staticSourcer) GetRCServers() ([]*DHCPServer, error) {
+	return nil, nil
+}
+
+func (s *staticSourcer) GetServersFromTier(tier string) ([]*DHCPServer, error) {
+	return s.stable, nil
+}
+
+// newTestConfig returns the config of a relay listening on a random loopback
+// port which balances on the given servers.
+func newTestConfig(version int, servers []*DHCPServer) *Config {
+	ip := net.ParseIP("127.0.0.1")
+	if version == 6 {
+		ip = net.IPv6loopback
+	}
+	algorithm := new(modulo)
+	algorithm.UpdateStableServerList(servers)
+	return &Config{
+		Version:              version,
+		Addr:                 &net.UDPAddr{IP: ip},
+		Algorithm:            algorithm,
+		ServerUpdateInterval: time.Minute,
+		PacketBufSize:        1500,
+		HostSourcer:          &staticSourcer{stable: servers},
+		Overrides:            map[string]Override{},
+		CacheSize:            64,
+		AffinitySize:         64,
+		RelayTableSize:       64,
+		ShutdownTimeout:      time.Second,
+		MaxHops:              defaultMaxHops(version),
+	}
+}
+
+func newTestServer(t testing.TB, config *Config) *Server {
+	server, err := NewServer(config, false, nil)
+	if err != nil {
+		t.Fatalf("Failed to create server: %s", err)
+	}
+	return server
+}
+
+// newLoggedTestServer returns a relay forwarding to a single backend, which
+// logs the error name of every packet handled to the returned channel.
+func newLoggedTestServer(t *testing.T, version int) (*Server, recordingLogger, func()) {
+	backend := newTestBackend(t, version)
+	logs := make(recordingLogger, 1)
+	server, err := NewServer(newTestConfig(version, []*DHCPServer{backend.server()}), false, logs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server, logs, func() {
+		server.conn.Close()
+		backend.conn.Close()
+	}
+}
+
+// serve runs server until the returned function is called.
+func serve(t testing.TB, server *Server) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error)
+	go func() {
+		errs <- server.ListenAndServe(ctx)
+	}()
+	return func() {
+		cancel()
+		select {
+		case err := <-errs:
+			if err != nil {
+				t.Fatalf("Unexpected error shutting down: %s", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("ListenAndServe didn't return after the context was cancelled")
+		}
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	server := newTestServer(t, newTestConfig(4, nil))
+	stop := serve(t, server)
+	time.Sleep(10 * time.Millisecond)
+	stop()
+	// the socket should have been closed
+	if _, err := server.conn.Write([]byte{0}); err == nil {
+		t.Fatalf("Socket still open after shutdown")
+	}
+}
+
+// blockingHandler holds the packets it serves until release is closed.
+type blockingHandler struct {
+	received chan struct{}
+	release  chan struct{}
+	// ctxErr gets the error of the context of the packets once released
+	ctxErr chan error
+}
+
+func (h *blockingHandler) serve(ctx context.Context) error {
+	h.received <- struct{}{}
+	<-h.release
+	h.ctxErr <- ctx.Err()
+	return errors.New("no reply")
+}
+
+func (h *blockingHandler) ServeDHCPv4(ctx context.Context, packet *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, error) {
+	return nil, h.serve(ctx)
+}
+
+func (h *blockingHandler) ServeDHCPv6(ctx context.Context, packet dhcpv6.DHCPv6) (dhcpv6.DHCPv6, error) {
+	return nil, h.serve(ctx)
+}
+
+func TestServerDrain(t *testing.T) {
+	backend := newTestBackend(t, 6)
+	defer backend.conn.Close()
+	handler := &blockingHandler{
+		received: make(chan struct{}, 1),
+		release:  make(chan struct{}),
+		ctxErr:   make(chan error, 1),
+	}
+	config := newTestConfig(6, nil)
+	config.BatchSize = 4
+	config.Handler = handler
+	server, err := NewServer(config, true, nil)
+	if err != nil {
+		t.Fatalf("Failed to create server: %s", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error)
+	go func() {
+		errs <- server.ListenAndServe(ctx)
+	}()
+
+	client, err := net.DialUDP("udp6", nil, server.conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("Failed to dial: %s", err)
+	}
+	defer client.Close()
+	if _, err := client.Write(newTestSolicit(t)); err != nil {
+		t.Fatalf("Failed to send: %s", err)
+	}
+	select {
+	case <-handler.received:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Packet wasn't handled")
+	}
+
+	cancel()
+	for !server.isStopping() {
+		time.Sleep(time.Millisecond)
+	}
+	// packets being handled can still be sent while draining
+	if err := server.writeTo(newTestSolicit(t), backend.conn.LocalAddr().(*net.UDPAddr)); err != nil {
+		t.Fatalf("Failed to send while draining: %s", err)
+	}
+	if !backend.wait(1) {
+		t.Fatalf("Packet sent while draining wasn't received")
+	}
+	close(handler.release)
+	if err := <-handler.ctxErr; err != nil {
+		t.Fatalf("Context of the packet cancelled while draining: %s", err)
+	}
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Fatalf("Unexpected error shutting down: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("ListenAndServe didn't return after the packets were drained")
+	}
+	if _, err := server.conn.Write([]byte{0}); err == nil {
+		t.Fatalf("Socket still open after shutdown")
+	}
+}
+
+func TestServerReusePort(t *testing.T) {
+	config := newTestConfig(4, nil)
+	config.ListenSockets = 4
+	// all the sockets have to share the same port, even an ephemeral one
+	server := newTestServer(t, config)
+	if len(server.conns) != config.ListenSockets {
+		t.Fatalf("Expected %d sockets, got %d", config.ListenSockets, len(server.conns))
+	}
+	addr := server.conn.LocalAddr().String()
+	for _, conn := range server.conns {
+		if conn.LocalAddr().String() != addr {
+			t.Fatalf("Socket bound to %s instead of %s", conn.LocalAddr(), addr)
+		}
+	}
+	stop := serve(t, server)
+	time.Sleep(10 * time.Millisecond)
+	stop()
+	for _, conn := range server.conns {
+		if _, err := conn.Write([]byte{0}); err == nil {
+			t.Fatalf("Socket %s still open after shutdown", conn.LocalAddr())
+		}
+	}
+}
@@ -71,6 +71,20 @@ func (c *Throttle) len() int {
 	return c.lru.Len()
 }
 
+// tokens returns the requests each key in the cache can currently make
+// without being throttled, along with the configured rate.
+func (c *Throttle) tokens() (map[string]float64, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	tokens := make(map[string]float64, c.lru.Len())
+	for _, key := range c.lru.Keys() {
+		if limiter, ok := c.lru.Peek(key); ok {
+			tokens[key] = limiter.Tokens()
+		}
+	}
+	return tokens, c.maxRatePerItem
+}
+
 func (c *Throttle) setRate(MaxRatePerItem int) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
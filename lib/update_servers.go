@@ -8,53 +8,104 @@
 package dhcplb
 
 import (
+	"context"
 	"time"
 
 	"github.com/golang/glog"
 )
 
-func (s *Server) startUpdatingServerList() {
+func (s *Server) startUpdatingServerList(ctx context.Context) {
 	glog.Infof("Starting to update server list...")
-	go s.updateServersContinuous()
+	go s.updateServersContinuous(ctx)
+	go s.health.run(ctx, s)
+	go s.replies.run(ctx, s)
 }
 
-func (s *Server) updateServersContinuous() {
+func (s *Server) updateServersContinuous(ctx context.Context) {
 	for {
 		config := s.GetConfig()
 		stable, err := config.HostSourcer.GetStableServers()
 		if err != nil {
 			glog.Error(err)
-		} else {
+		}
+		rc, rcErr := config.HostSourcer.GetRCServers()
+		if rcErr != nil {
+			glog.Error(rcErr)
+		}
+		// probe every server we know about, but only hand the healthy ones
+		// to the balancing algorithm. If a list failed to load keep the state
+		// of its servers until it loads again.
+		if err == nil && rcErr == nil {
+			s.health.setServers(append(append([]*DHCPServer{}, stable...), rc...))
+		}
+		stable = s.markDraining(filterServers("stable", stable, s.isAvailable))
+		rc = s.markDraining(filterServers("rc", rc, s.isAvailable))
+
+		if err == nil {
 			glog.Infof("Adding %d servers to the stable servers list", len(stable))
 			if len(stable) > 0 {
-				s.handleUpdatedList(s.stableServers, stable)
+				old, _ := s.serverLists()
+				s.handleUpdatedList(old, stable)
 				err = config.Algorithm.UpdateStableServerList(stable)
 				if err != nil {
 					glog.Errorf("Error updating stable server list: %s", err)
 				} else {
+					s.serversLock.Lock()
 					s.stableServers = stable
+					s.serversLock.Unlock()
 				}
 			}
 		}
 
-		rc, err := config.HostSourcer.GetRCServers()
-		if err != nil {
-			glog.Error(err)
-		} else {
+		if rcErr == nil {
 			glog.Infof("Adding %d servers to the list of RC servers", len(rc))
 			if len(rc) > 0 {
-				s.handleUpdatedList(s.rcServers, rc)
+				_, old := s.serverLists()
+				s.handleUpdatedList(old, rc)
 				err = config.Algorithm.UpdateRCServerList(rc)
 				if err != nil {
 					glog.Errorf("Error updating RC server list: %s", err)
 				} else {
+					s.serversLock.Lock()
 					s.rcServers = rc
+					s.serversLock.Unlock()
 				}
 			}
 		}
 
-		<-time.NewTimer(config.ServerUpdateInterval).C
+		select {
+		case <-time.NewTimer(config.ServerUpdateInterval).C:
+		case <-s.health.changed:
+		case <-s.replies.changed:
+		case <-s.admin.changed:
+		case <-ctx.Done():
+			glog.Infof("Stopped updating server list")
+			return
+		}
+	}
+}
+
+// isAvailable returns false for servers that failed their health checks or
+// stopped replying to the requests we forward them.
+func (s *Server) isAvailable(server *DHCPServer) bool {
+	return s.health.isHealthy(server) && !s.replies.isDegraded(server)
+}
+
+// filterServers returns the servers from list for which available is true.
+// If none of them is available the original list is returned, sending traffic
+// to servers that might be down is better than dropping all of it.
+func filterServers(name string, list []*DHCPServer, available func(*DHCPServer) bool) []*DHCPServer {
+	filtered := make([]*DHCPServer, 0, len(list))
+	for _, server := range list {
+		if available(server) {
+			filtered = append(filtered, server)
+		}
+	}
+	if len(filtered) == 0 && len(list) > 0 {
+		glog.Errorf("All %d %s servers are unavailable, using them anyway", len(list), name)
+		return list
 	}
+	return filtered
 }
 
 func (s *Server) handleUpdatedList(old, new []*DHCPServer) {
@@ -0,0 +1,119 @@
+/**
+ * Copyright (c) Facebook, Inc. and its affiliates.
+ *
+ * This source code is licensed under the MIT license found in the
+ * LICENSE file in the root directory of this source tree.
+ */
+
+package dhcplb
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Policies applied when a packet is received and the queue of the worker pool
+// is full.
+const (
+	// DropNewest drops the packet which was just received.
+	DropNewest = "drop-newest"
+	// DropOldest drops the packet which has been waiting in the queue for the
+	// longest time, and queues the one just received. Clients retransmit, so
+	// old packets are the most likely to have been superseded.
+	DropOldest = "drop-oldest"
+)
+
+// defaultQueueSize is the size of the queue of the worker pool, per worker,
+// when not specified in the config.
+const defaultQueueSize = 64
+
+// WorkerPoolConfig holds the settings of the pool of goroutines handling
+// packets.
+type WorkerPoolConfig struct {
+	Workers    int
+	QueueSize  int
+	DropPolicy string
+}
+
+// rawPacket is a packet waiting in the queue of the worker pool.
+type rawPacket struct {
+	buffer   *[]byte
+	peer     *net.UDPAddr
+	received time.Time
+}
+
+// workerPool handles packets with a fixed number of goroutines instead of
+// spawning one per packet, so that memory usage stays bounded during storms.
+type workerPool struct {
+	queue      chan *rawPacket
+	dropPolicy string
+	// depth is the queue_depth gauge of the pool's version
+	depth prometheus.Gauge
+}
+
+func newWorkerPool(config *WorkerPoolConfig, version int) *workerPool {
+	return &workerPool{
+		queue:      make(chan *rawPacket, config.QueueSize),
+		dropPolicy: config.DropPolicy,
+		depth:      queueDepth.WithLabelValues(strconv.Itoa(version)),
+	}
+}
+
+// start spawns the workers, they return once the queue is closed and drained.
+func (p *workerPool) start(ctx context.Context, s *Server, workers int) {
+	glog.Infof("Starting %d workers with a queue of %d packets", workers, cap(p.queue))
+	for i := 0; i < workers; i++ {
+		go func() {
+			for packet := range p.queue {
+				p.depth.Set(float64(len(p.queue)))
+				s.handlePacket(ctx, *packet.buffer, packet.peer)
+				s.putBuffer(packet.buffer)
+				s.inflight.Done()
+			}
+		}()
+	}
+}
+
+// enqueue queues a packet for the workers, applying the drop policy if the
+// queue is full.
+func (p *workerPool) enqueue(s *Server, packet *rawPacket) {
+	select {
+	case p.queue <- packet:
+		p.depth.Set(float64(len(p.queue)))
+		return
+	default:
+	}
+	if p.dropPolicy == DropOldest {
+		select {
+		case oldest := <-p.queue:
+			p.drop(s, oldest)
+		default:
+		}
+		select {
+		case p.queue <- packet:
+			return
+		default:
+		}
+	}
+	p.drop(s, packet)
+}
+
+func (p *workerPool) drop(s *Server, packet *rawPacket) {
+	err := fmt.Errorf("queue full (%d packets), dropping packet received at %s",
+		cap(p.queue), packet.received.Format(time.RFC3339Nano))
+	glog.Errorf("Error handling packet from %s: %s", packet.peer, err)
+	s.logger.LogErr(packet.received, nil, *packet.buffer, packet.peer, ErrQueue, err)
+	s.putBuffer(packet.buffer)
+	s.inflight.Done()
+}
+
+// close stops accepting packets, the workers exit once the queue is drained.
+func (p *workerPool) close() {
+	close(p.queue)
+}
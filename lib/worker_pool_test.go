@@ -0,0 +1,124 @@
+/**
+ * Copyright (c) Facebook, Inc. and its affiliates.
+ *
+ * This source code is licensed under the MIT license found in the
+ * LICENSE file in the root directory of this source tree.
+ */
+
+package dhcplb
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestWorkerPoolDropPolicy(t *testing.T) {
+	for _, tt := range []struct {
+		policy   string
+		expected []byte
+	}{
+		{DropNewest, []byte{0, 1}},
+		{DropOldest, []byte{1, 2}},
+	} {
+		t.Run(tt.policy, func(t *testing.T) {
+			s := &Server{logger: &loggerHelper{}}
+			pool := newWorkerPool(&WorkerPoolConfig{
+				Workers:    1,
+				QueueSize:  2,
+				DropPolicy: tt.policy,
+			}, 4)
+			for i := byte(0); i < 3; i++ {
+				s.inflight.Add(1)
+				pool.enqueue(s, &rawPacket{buffer: &[]byte{i}, received: time.Now()})
+			}
+			pool.close()
+			var queued []byte
+			for packet := range pool.queue {
+				queued = append(queued, (*packet.buffer)[0])
+				s.inflight.Done()
+			}
+			if string(queued) != string(tt.expected) {
+				t.Fatalf("Expected packets %v in the queue, got %v", tt.expected, queued)
+			}
+			// dropped packets must not be waited for on shutdown
+			s.inflight.Wait()
+		})
+	}
+}
+
+func TestServerWorkerPool(t *testing.T) {
+	handler := &blockingHandler{
+		received: make(chan struct{}, 2),
+		release:  make(chan struct{}),
+		ctxErr:   make(chan error, 2),
+	}
+	config := newTestConfig(6, nil)
+	config.Handler = handler
+	config.WorkerPool = &WorkerPoolConfig{Workers: 1, QueueSize: 1, DropPolicy: DropNewest}
+	logs := make(recordingLogger, 16)
+	server, err := NewServer(config, true, logs)
+	if err != nil {
+		t.Fatalf("Failed to create server: %s", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error)
+	go func() {
+		errs <- server.ListenAndServe(ctx)
+	}()
+
+	client, err := net.DialUDP("udp6", nil, server.conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("Failed to dial: %s", err)
+	}
+	defer client.Close()
+	send := func() {
+		if _, err := client.Write(newTestSolicit(t)); err != nil {
+			t.Fatalf("Failed to send: %s", err)
+		}
+	}
+	// the only worker is busy with the first packet, the second one fills
+	// the queue and the third one is dropped
+	send()
+	select {
+	case <-handler.received:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Packet wasn't handled")
+	}
+	send()
+	send()
+	select {
+	case name := <-logs:
+		if name != ErrQueue {
+			t.Fatalf("Expected %s, got %q", ErrQueue, name)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Packet wasn't dropped")
+	}
+
+	// the queued packet is still handled once we are asked to stop
+	cancel()
+	for !server.isStopping() {
+		time.Sleep(time.Millisecond)
+	}
+	close(handler.release)
+	select {
+	case <-handler.received:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Queued packet wasn't handled while draining")
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-handler.ctxErr; err != nil {
+			t.Fatalf("Context of the packet cancelled while draining: %s", err)
+		}
+	}
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Fatalf("Unexpected error shutting down: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("ListenAndServe didn't return after the queue was drained")
+	}
+}
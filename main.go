@@ -13,31 +13,57 @@ import (
 	"fmt"
 	"net/http"
 	_ "net/http/pprof"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 
 	dhcplb "github.com/facebookincubator/dhcplb/lib"
 	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 // Program parameters
 var (
 	version       = flag.Int("version", 4, "Run in v4/v6 mode")
-	configPath    = flag.String("config", "", "Path to JSON config file")
-	overridesPath = flag.String("overrides", "", "Path to JSON overrides file")
+	configPath    = flag.String("config", "", "Path to config file (JSON, YAML or TOML)")
+	overridesPath = flag.String("overrides", "", "Path to overrides file (JSON, YAML or TOML)")
 	pprofPort     = flag.Int("pprof", 0, "Port to run pprof HTTP server on")
+	metricsPort   = flag.Int("metrics", 0, "Port to run Prometheus metrics HTTP server on")
+	adminPort     = flag.Int("admin", 0, "Port to run the admin HTTP API on")
 	serverMode    = flag.Bool("server", false, "Run in server mode. The default is relay mode.")
+	dualStack     = flag.Bool("dualstack", false, "Serve both v4 and v6 from the same process, -version is ignored")
+	setLayer      = dhcplb.NewConfigLayer("flag")
 )
 
+func init() {
+	flag.Var(setFlag{setLayer}, "set", setUsage)
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		// only print the problems found, not the logs of the config loader
+		flag.Lookup("stderrthreshold").Value.Set("FATAL")
+		os.Exit(validate(os.Args[2:], NewDefaultConfigProvider(), os.Stdout))
+	}
+
 	flag.Parse()
 	flag.Lookup("logtostderr").Value.Set("true")
 
-	ctx, cancel := context.WithCancel(context.Background())
+	// stop gracefully on SIGTERM/SIGINT, so that rolling restarts don't drop
+	// the packets being handled
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
 	defer cancel()
 
 	if *configPath == "" {
 		glog.Fatal("Config file is necessary")
 	}
+	if err := setConfigLayers(setLayer); err != nil {
+		glog.Fatalf("Invalid config environment variables: %s", err)
+	}
 
+	// metrics are also served by the pprof server
+	http.Handle("/metrics", promhttp.Handler())
 	if *pprofPort != 0 {
 		go func() {
 			glog.Infof("Started pprof server on port %d", *pprofPort)
@@ -48,36 +74,87 @@ func main() {
 		}()
 	}
 
-	logger := NewGlogLogger()
+	if *metricsPort != 0 {
+		go func() {
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", promhttp.Handler())
+			glog.Infof("Started metrics server on port %d", *metricsPort)
+			err := http.ListenAndServe(fmt.Sprintf(":%d", *metricsPort), mux)
+			if err != nil {
+				glog.Fatal("Error starting metrics server: ", err)
+			}
+		}()
+	}
 
-	// load initial config
+	logger := dhcplb.NewMultiLogger(NewGlogLogger(), dhcplb.NewPrometheusLogger())
+
+	versions := []int{*version}
+	if *dualStack {
+		versions = []int{4, 6}
+	}
+
+	// load initial config, and create a server for each version
 	provider := NewDefaultConfigProvider()
-	config, err := dhcplb.LoadConfig(
-		*configPath, *overridesPath, *version, provider)
-	if err != nil {
-		glog.Fatalf("Failed to load config: %s", err)
+	servers := make(map[int]*dhcplb.Server, len(versions))
+	for _, version := range versions {
+		config, err := dhcplb.LoadConfig(
+			*configPath, *overridesPath, version, provider)
+		if err != nil {
+			glog.Fatalf("Failed to load v%d config: %s", version, err)
+		}
+		servers[version], err = dhcplb.NewServer(config, *serverMode, logger)
+		if err != nil {
+			glog.Fatal(err)
+		}
 	}
 
 	// start watching config
-	configChan, err := dhcplb.WatchConfig(
-		*configPath, *overridesPath, *version, provider)
+	configChans, err := dhcplb.WatchConfigs(
+		ctx, *configPath, *overridesPath, versions, provider)
 	if err != nil {
 		glog.Fatalf("Failed to watch config: %s", err)
 	}
 
-	server, err := dhcplb.NewServer(config, *serverMode, logger)
-	if err != nil {
-		glog.Fatal(err)
+	if *adminPort != 0 {
+		go func() {
+			mux := http.NewServeMux()
+			for version, server := range servers {
+				prefix := fmt.Sprintf("/v%d", version)
+				mux.Handle(prefix+"/", http.StripPrefix(prefix, server.AdminHandler()))
+			}
+			glog.Infof("Started admin server on port %d", *adminPort)
+			err := http.ListenAndServe(fmt.Sprintf(":%d", *adminPort), mux)
+			if err != nil {
+				glog.Fatal("Error starting admin server: ", err)
+			}
+		}()
 	}
 
-	// update server config whenever file changes
-	go func() {
-		for config := range configChan {
-			glog.Info("Config changed")
-			server.SetConfig(config)
-		}
-	}()
+	var wg sync.WaitGroup
+	errs := make(chan error, len(servers))
+	for version, server := range servers {
+		// update server config whenever file changes
+		go func(server *dhcplb.Server, configChan chan *dhcplb.Config) {
+			for config := range configChan {
+				glog.Infof("v%d config changed", config.Version)
+				server.SetConfig(config)
+			}
+		}(server, configChans[version])
 
-	glog.Infof("Starting dhcplb in v%d mode", *version)
-	glog.Fatal(server.ListenAndServe(ctx))
+		glog.Infof("Starting dhcplb in v%d mode", version)
+		wg.Add(1)
+		go func(server *dhcplb.Server) {
+			defer wg.Done()
+			if err := server.ListenAndServe(ctx); err != nil {
+				errs <- err
+			}
+		}(server)
+	}
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		glog.Fatal(err)
+	}
+	glog.Infof("dhcplb stopped")
+	glog.Flush()
 }
@@ -0,0 +1,51 @@
+/**
+ * Copyright (c) Facebook, Inc. and its affiliates.
+ *
+ * This source code is licensed under the MIT license found in the
+ * LICENSE file in the root directory of this source tree.
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+
+	dhcplb "github.com/facebookincubator/dhcplb/lib"
+)
+
+// validate implements the validate subcommand: it loads the config and
+// overrides files like dhcplb would at startup, without opening any socket,
+// prints the problems found to out and returns the exit code.
+func validate(args []string, provider dhcplb.ConfigProvider, out io.Writer) int {
+	flags := flag.NewFlagSet("validate", flag.ContinueOnError)
+	flags.SetOutput(out)
+	version := flags.Int("version", 4, "Validate the v4/v6 section")
+	configPath := flags.String("config", "", "Path to config file (JSON, YAML or TOML)")
+	overridesPath := flags.String("overrides", "", "Path to overrides file (JSON, YAML or TOML)")
+	layer := dhcplb.NewConfigLayer("flag")
+	flags.Var(setFlag{layer}, "set", setUsage)
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *configPath == "" {
+		fmt.Fprintln(out, "Config file is necessary")
+		return 2
+	}
+	if err := setConfigLayers(layer); err != nil {
+		fmt.Fprintf(out, "Invalid config environment variables: %s\n", err)
+		return 1
+	}
+
+	errs := dhcplb.ValidateConfigFiles(*configPath, *overridesPath, *version, provider)
+	if len(errs) > 0 {
+		fmt.Fprintf(out, "Found %d problem(s) in the v%d config:\n", len(errs), *version)
+		for _, err := range errs {
+			fmt.Fprintf(out, "  %s\n", err)
+		}
+		return 1
+	}
+	fmt.Fprintf(out, "The v%d config is valid\n", *version)
+	return 0
+}